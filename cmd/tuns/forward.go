@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// forward runs `tuns forward --listen 127.0.0.1:5432 --to <peerID|auto>:host:port`
+// and carries every accepted TCP connection to host:port through an exit,
+// with --udp every local source address gets its own UDP flow instead.
+func forward(args []string) {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:0", "local address to listen on")
+	to := fs.String("to", "", "target as <peerID|auto>:host:port")
+	udp := fs.Bool("udp", false, "forward UDP datagrams instead of TCP")
+	fs.Parse(args)
+
+	pin, addr, err := parseForwardTarget(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := p2p.NewP2PServer(clientOptions(loadOptions()))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var ln io.Closer
+	if *udp {
+		pc, err := net.ListenPacket("udp", *listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Forwarding udp", pc.LocalAddr().String(), "to", addr)
+		go forwardPackets(server, pc, addr, pin)
+		ln = pc
+	} else {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Forwarding", l.Addr().String(), "to", addr)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go forwardConn(server, conn, addr, pin)
+			}
+		}()
+		ln = l
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	<-sigc
+	ln.Close()
+	server.Stop()
+}
+
+var fixedPort = regexp.MustCompile(`/(tcp|udp)/[0-9]+`)
+
+// clientOptions turns the daemon config into one for a helper node that
+// may run next to the daemon: own throwaway identity, consumer only, random
+// p2p ports and no listeners or published services of its own. The state of
+// the daemon is only read, so known exits are usable right away.
+func clientOptions(o *opts.Options) *opts.Options {
+	o.Ephemeral = true
+	o.Role = opts.RoleConsumer
+	o.Server.SNIPort = ""
+	o.Server.ProxyPort = ""
+	o.DNS.Listen = ""
+	o.State.ReadOnly = true
+	o.Publish = nil
+	o.MultiHop.Serve = false
+	for i, a := range o.P2P.ListenAddrs {
+		o.P2P.ListenAddrs[i] = fixedPort.ReplaceAllString(a, "/$1/0")
+	}
+	return o
+}
+
+func parseForwardTarget(to string) (peer.ID, string, error) {
+	id, addr, ok := strings.Cut(to, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid --to %q, want <peerID|auto>:host:port", to)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid --to %q: %v", to, err)
+	}
+	if id == "auto" {
+		return "", addr, nil
+	}
+	pin, err := peer.Decode(id)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid peer in --to %q: %v", to, err)
+	}
+	return pin, addr, nil
+}
+
+func forwardConn(server *p2p.P2PServer, conn net.Conn, addr string, pin peer.ID) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	remote, err := server.Dial(ctx, addr, pin)
+	cancel()
+	if err != nil {
+		log.Printf("[FORWARD] %s: %v", addr, err)
+		return
+	}
+	defer remote.Close()
+
+	utils.Splice(conn, remote)
+}
+
+// flowQueue is how many datagrams of one source wait for its flow.
+const flowQueue = 64
+
+func forwardPackets(server *p2p.P2PServer, pc net.PacketConn, addr string, pin peer.ID) {
+	var mu sync.Mutex
+	flows := make(map[string]chan []byte)
+
+	// serve runs the flow of one source, dialing it here keeps a slow exit
+	// from holding up the datagrams of the other sources
+	serve := func(src net.Addr, queue chan []byte) {
+		defer func() {
+			mu.Lock()
+			if flows[src.String()] == queue {
+				delete(flows, src.String())
+			}
+			mu.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		flow, err := server.DialUDP(ctx, addr, pin)
+		cancel()
+		if err != nil {
+			log.Printf("[FORWARD] %s: %v", addr, err)
+			return
+		}
+		defer flow.Close()
+
+		// the exit ends idle flows, which ends this reader too
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			b := make([]byte, 65535)
+			for {
+				n, err := flow.Read(b)
+				if err != nil {
+					return
+				}
+				if _, err = pc.WriteTo(b[:n], src); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case pkt := <-queue:
+				if _, err := flow.Write(pkt); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		queue := flows[src.String()]
+		if queue == nil {
+			queue = make(chan []byte, flowQueue)
+			flows[src.String()] = queue
+			go serve(src, queue)
+		}
+		mu.Unlock()
+
+		// a full queue drops the datagram, like a congested link would
+		select {
+		case queue <- bytes.Clone(buf[:n]):
+		default:
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"os/signal"
 	"syscall"
 
@@ -19,18 +20,13 @@ import (
 func main() {
 	flag.Parse()
 
-	opts := opts.DefOptions()
-	buf, err := os.ReadFile("tuns.conf")
-	if err != nil {
-		buf, _ = yaml.Marshal(&opts)
-		os.WriteFile("tuns.conf", buf, 0644)
-	} else {
-		err = yaml.Unmarshal(buf, &opts)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if flag.Arg(0) == "forward" {
+		forward(flag.Args()[1:])
+		return
 	}
 
+	opts := loadOptions()
+
 	server, err := p2p.NewP2PServer(opts)
 	if err != nil {
 		log.Fatal(err)
@@ -41,7 +37,13 @@ func main() {
 
 	route.Use(gin.Recovery())
 
-	route.Any("/proxy/*url", server.GinHandler)
+	if opts.Profile().Gateway {
+		route.Any("/proxy/*url", server.GinHandler)
+		route.GET("/resolve", server.ResolveHandler)
+		if opts.Server.ProxyPort != "" {
+			route.GET("/proxy.pac", server.PacHandler)
+		}
+	}
 	route.GET("/status", func(c *gin.Context) {
 		st := server.Status()
 		c.JSON(http.StatusOK, st)
@@ -64,3 +66,19 @@ func main() {
 	<-sigc
 	server.Stop()
 }
+
+func loadOptions() *opts.Options {
+	opts := opts.DefOptions()
+	opts.ConfigDir, _ = filepath.Abs(".")
+	buf, err := os.ReadFile("tuns.conf")
+	if err != nil {
+		buf, _ = yaml.Marshal(&opts)
+		os.WriteFile("tuns.conf", buf, 0644)
+	} else {
+		err = yaml.Unmarshal(buf, &opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return opts
+}
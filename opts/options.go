@@ -1,31 +1,202 @@
 package opts
 
+import "net"
+
+type Transports struct {
+	TCP          bool `yaml:"tcp"`
+	QUIC         bool `yaml:"quic"`
+	WebTransport bool `yaml:"webtransport"`
+	WebSocket    bool `yaml:"websocket"`
+	WebRTC       bool `yaml:"webrtc_direct"`
+}
+
+// HopRule routes hosts through a middle peer, so the exit sees the middle
+// peer ID instead of ours. Empty lists allow any peer.
+type HopRule struct {
+	Hosts  []string `yaml:"hosts"`
+	Middle []string `yaml:"middle"`
+	Exits  []string `yaml:"exits"`
+}
+
+// ResourceLimits are libp2p resource manager limits of one scope,
+// 0 keeps the default and -1 is unlimited.
+type ResourceLimits struct {
+	Streams         int   `yaml:"streams"`
+	StreamsInbound  int   `yaml:"streams_inbound"`
+	StreamsOutbound int   `yaml:"streams_outbound"`
+	Conns           int   `yaml:"conns"`
+	ConnsInbound    int   `yaml:"conns_inbound"`
+	ConnsOutbound   int   `yaml:"conns_outbound"`
+	FD              int   `yaml:"fd"`
+	MemoryMB        int64 `yaml:"memory_mb"`
+}
+
 type Options struct {
+	Role string `yaml:"role"`
+
+	// Ephemeral runs the node under a throwaway identity, for helper
+	// commands started next to a daemon that owns node.key
+	Ephemeral bool `yaml:"-"`
+	// ConfigDir is the directory of the config file, relative host list
+	// paths are resolved against it
+	ConfigDir string `yaml:"-"`
+
 	Server struct {
 		Port      string `yaml:"port"`
 		Slots     int    `yaml:"slots"`
 		SlotSleep int    `yaml:"slot_sleep"`
+		SNIPort   string `yaml:"sni_port"`
+		ProxyPort string `yaml:"proxy_port"`
 	} `yaml:"server"`
 
 	P2P struct {
-		LowConns int `yaml:"low_conns"`
-		HiConns  int `yaml:"hi_conns"`
+		LowConns    int        `yaml:"low_conns"`
+		HiConns     int        `yaml:"hi_conns"`
+		MDNS        bool       `yaml:"mdns"`
+		LanOnly     bool       `yaml:"lan_only"`
+		ListenAddrs []string   `yaml:"listen_addrs"`
+		Transports  Transports `yaml:"transports"`
+
+		ForceReachability string `yaml:"force_reachability"`
+
+		AnnounceAddrs []string `yaml:"announce_addrs"`
+		AppendAddrs   []string `yaml:"append_addrs"`
+		FilterCIDRs   []string `yaml:"filter_cidrs"`
 	} `yaml:"p2p"`
 
-	Hosts []string `yaml:"provided_hosts"`
+	Relay struct {
+		Service               bool     `yaml:"service"`
+		MaxReservations       int      `yaml:"max_reservations"`
+		MaxCircuits           int      `yaml:"max_circuits"`
+		MaxReservationsPerIP  int      `yaml:"max_reservations_per_ip"`
+		MaxReservationsPerASN int      `yaml:"max_reservations_per_asn"`
+		ReservationTTL        int      `yaml:"reservation_ttl"`
+		CircuitDuration       int      `yaml:"circuit_duration"`
+		CircuitData           int64    `yaml:"circuit_data"`
+		StaticRelays          []string `yaml:"static_relays"`
+	} `yaml:"relay"`
+
+	Resources struct {
+		System    ResourceLimits            `yaml:"system"`
+		Peer      ResourceLimits            `yaml:"peer"`
+		Protocols map[string]ResourceLimits `yaml:"protocols"`
+	} `yaml:"resources"`
+
+	DNS struct {
+		Listen   string   `yaml:"listen"`
+		Address  []string `yaml:"address"`
+		Upstream []string `yaml:"upstream"`
+		Hosts    []string `yaml:"hosts"`
+		TTL      int      `yaml:"ttl"`
+	} `yaml:"dns"`
+
+	UDP struct {
+		IdleTimeout int `yaml:"idle_timeout"`
+	} `yaml:"udp"`
+
+	// Labels are announced with the provided hosts, consumers select exits by them
+	Labels map[string]string `yaml:"labels"`
+
+	Routes    []Route           `yaml:"routes"`
+	Upstreams map[string]string `yaml:"upstreams"`
+
+	MultiHop struct {
+		Serve bool      `yaml:"serve"`
+		Rules []HopRule `yaml:"rules"`
+	} `yaml:"multi_hop"`
+
+	Access struct {
+		DenyUse   []string `yaml:"deny_use"`
+		DenyServe []string `yaml:"deny_serve"`
+		OnlyUse   []string `yaml:"only_use"`
+		OnlyServe []string `yaml:"only_serve"`
+	} `yaml:"access"`
+
+	State struct {
+		Dir          string `yaml:"dir"`
+		SaveInterval int    `yaml:"save_interval"`
+		MaxAgeHours  int    `yaml:"max_age_hours"`
+		// ReadOnly restores the state without ever writing it back
+		ReadOnly bool `yaml:"-"`
+	} `yaml:"state"`
+
+	Hosts       []string    `yaml:"provided_hosts"`
+	HostsReload int         `yaml:"provided_hosts_reload"`
+	Publish     []Published `yaml:"publish"`
 }
 
 func DefOptions() *Options {
 	cfg := &Options{}
 
+	cfg.Role = RoleFull
+
 	cfg.Server.Port = "8080"
 	cfg.Server.Slots = 5
 	cfg.Server.SlotSleep = 1
 
 	cfg.P2P.LowConns = 50
 	cfg.P2P.HiConns = 200
+	cfg.P2P.MDNS = true
+	cfg.P2P.LanOnly = false
+	cfg.P2P.ListenAddrs = []string{
+		"/ip4/0.0.0.0/tcp/0",
+		"/ip6/::/tcp/0",
+		"/ip4/0.0.0.0/udp/0/quic-v1",
+		"/ip6/::/udp/0/quic-v1",
+		"/ip4/0.0.0.0/udp/0/quic-v1/webtransport",
+		"/ip6/::/udp/0/quic-v1/webtransport",
+		"/ip4/0.0.0.0/tcp/0/ws",
+		"/ip6/::/tcp/0/ws",
+		"/ip4/0.0.0.0/udp/0/webrtc-direct",
+		"/ip6/::/udp/0/webrtc-direct",
+	}
+	cfg.P2P.Transports = Transports{
+		TCP:          true,
+		QUIC:         true,
+		WebTransport: true,
+	}
+
+	cfg.Relay.Service = true
+	cfg.Relay.MaxReservations = 128
+	cfg.Relay.MaxCircuits = 16
+	cfg.Relay.MaxReservationsPerIP = 8
+	cfg.Relay.MaxReservationsPerASN = 32
+	cfg.Relay.ReservationTTL = 3600
+	cfg.Relay.CircuitDuration = 120
+	cfg.Relay.CircuitData = 1 << 21 //2 mb
+
+	cfg.DNS.TTL = 60
+
+	cfg.UDP.IdleTimeout = 60
+
+	cfg.MultiHop.Serve = true
+
+	cfg.Resources.Protocols = map[string]ResourceLimits{
+		"/tunsgo/urlproxy/1.0.0": {StreamsInbound: 64, Streams: 256},
+		"/tunsgo/hop/1.0.0":      {StreamsInbound: 64, Streams: 256},
+		"/tunsgo/hostpex/1.0.0":  {StreamsInbound: 16, Streams: 32},
+		"/tunsgo/hostpex/2.0.0":  {StreamsInbound: 16, Streams: 32},
+		"/tunsgo/pex/1.0.0":      {StreamsInbound: 16, Streams: 32},
+		"/tunsgo/udp/1.0.0":      {StreamsInbound: 64, Streams: 256},
+		"/tunsgo/dns/1.0.0":      {StreamsInbound: 64, Streams: 128},
+	}
+
+	cfg.State.Dir = "state"
+	cfg.State.SaveInterval = 300
+	cfg.State.MaxAgeHours = 72
 
 	cfg.Hosts = []string{"*themoviedb.org", "*tmdb.org"}
+	cfg.HostsReload = 10
 
 	return cfg
 }
+
+// ProxyAddr returns the listen address of the forward proxy and its port.
+// A bare proxy_port listens on loopback only, other machines are served
+// with an explicit address such as "0.0.0.0:8118".
+func (o *Options) ProxyAddr() (string, string) {
+	if _, port, err := net.SplitHostPort(o.Server.ProxyPort); err == nil {
+		return o.Server.ProxyPort, port
+	}
+	return net.JoinHostPort("127.0.0.1", o.Server.ProxyPort), o.Server.ProxyPort
+}
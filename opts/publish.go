@@ -0,0 +1,26 @@
+package opts
+
+import "strings"
+
+// TunsSuffix is the pseudo TLD of services published into the mesh.
+const TunsSuffix = ".tuns"
+
+// Published is a local service reachable by other peers as <name>.<owner>.tuns.
+// Allow lists the peer IDs that may use it, "*" allows everyone.
+type Published struct {
+	Name   string   `yaml:"name"`
+	Target string   `yaml:"target"`
+	Allow  []string `yaml:"allow"`
+}
+
+// PublishedHosts returns the .tuns names of the published services, owner
+// binds them to the publishing peer.
+func (o *Options) PublishedHosts(owner string) []string {
+	var hosts []string
+	for _, p := range o.Publish {
+		if p.Name != "" {
+			hosts = append(hosts, strings.ToLower(p.Name)+"."+owner+TunsSuffix)
+		}
+	}
+	return hosts
+}
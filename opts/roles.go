@@ -0,0 +1,60 @@
+package opts
+
+import "fmt"
+
+const (
+	RoleFull           = "full"
+	RoleConsumer       = "consumer"
+	RoleExit           = "exit"
+	RoleInfrastructure = "infrastructure"
+	RoleRelay          = "relay"
+)
+
+// Profile is the set of components a node role runs.
+type Profile struct {
+	Gateway   bool // HTTP /proxy gateway
+	Consume   bool // use exits of other peers
+	Exit      bool // serve urlproxy streams and announce provided hosts
+	Relay     bool // circuit relay service, forced on when set
+	DHTServer bool // DHT in server mode instead of auto
+}
+
+var roles = map[string]Profile{
+	RoleFull:           {Gateway: true, Consume: true, Exit: true},
+	RoleConsumer:       {Gateway: true, Consume: true},
+	RoleExit:           {Exit: true},
+	RoleInfrastructure: {Relay: true, DHTServer: true},
+	RoleRelay:          {Relay: true},
+}
+
+// CheckRole validates the configured role, an empty role means full.
+func (o *Options) CheckRole() error {
+	if o.Role == "" {
+		o.Role = RoleFull
+	}
+	if _, ok := roles[o.Role]; !ok {
+		return fmt.Errorf("unknown role %q", o.Role)
+	}
+	return nil
+}
+
+// Profile returns the components run by the configured role.
+func (o *Options) Profile() Profile {
+	if p, ok := roles[o.Role]; ok {
+		return p
+	}
+	return roles[RoleFull]
+}
+
+// RelayService reports whether the node runs the circuit relay service.
+// Consumers never relay, full and exit nodes follow the relay config.
+func (o *Options) RelayService() bool {
+	p := o.Profile()
+	switch {
+	case p.Relay:
+		return true
+	case o.Role == RoleConsumer:
+		return false
+	}
+	return o.Relay.Service
+}
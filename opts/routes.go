@@ -0,0 +1,27 @@
+package opts
+
+// Route actions, a host matching no rule goes local when we provide it
+// and through the mesh otherwise.
+const (
+	RouteDirect        = "direct"
+	RouteMesh          = "mesh"
+	RouteMeshOnlyPeers = "mesh-only-peers"
+	RouteUpstream      = "upstream"
+	RouteBlock         = "block"
+	RouteLocalThenMesh = "local-then-mesh"
+)
+
+// Route decides how a consumer reaches the hosts it matches, the first
+// matching rule of the table wins. Action takes an argument after a colon:
+// mesh-only-peers:[id1,id2] or upstream:<name>.
+type Route struct {
+	Hosts  []string `yaml:"hosts"`
+	Action string   `yaml:"action"`
+	// Timeout bounds each attempt until the response headers or the tunnel
+	// are there, in seconds, 0 keeps the defaults
+	Timeout int `yaml:"timeout"`
+	// Attempts is how many exits are tried, 0 tries all of them
+	Attempts int `yaml:"attempts"`
+	// Labels select the exits by their labels: region=eu, type?=residential
+	Labels []string `yaml:"labels"`
+}
@@ -0,0 +1,27 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/YouROK/tunsgo/p2p/services/udprelay"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Dial opens a TCP connection to addr through an exit of the mesh, pin
+// selects the exit, an empty one picks it by the announced hosts.
+func (s *P2PServer) Dial(ctx context.Context, addr string, pin peer.ID) (net.Conn, error) {
+	if s.urlprx == nil {
+		return nil, fmt.Errorf("role %q does not proxy", s.opts.Role)
+	}
+	return s.urlprx.Dial(ctx, addr, pin)
+}
+
+// DialUDP opens a UDP flow to addr through an exit of the mesh.
+func (s *P2PServer) DialUDP(ctx context.Context, addr string, pin peer.ID) (*udprelay.Flow, error) {
+	if s.udp == nil {
+		return nil, fmt.Errorf("role %q does not proxy", s.opts.Role)
+	}
+	return s.udp.Dial(ctx, addr, pin)
+}
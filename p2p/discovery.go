@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -13,6 +14,9 @@ import (
 )
 
 func (s *P2PServer) startDiscovery() {
+	if s.opts.P2P.LanOnly {
+		return
+	}
 	time.Sleep(time.Second * 5)
 	s.bootstrap()
 	go s.announceDht()
@@ -93,9 +97,7 @@ func (s *P2PServer) discoveryPeers() {
 			if s.host.Network().Connectedness(p.ID) != network.Connected {
 				err := s.host.Connect(s.ctx, p)
 				if err == nil {
-					s.host.ConnManager().UpsertTag(p.ID, "tuns-node", func(current int) int {
-						return 100
-					})
+					s.srvctx.Rep.Record(p.ID, reputation.Connected)
 					s.srvctx.MuPeers.Lock()
 					if info, ok := s.srvctx.Peers[p.ID]; ok {
 						info.LastSeen = time.Now()
@@ -1,6 +1,13 @@
 package p2p
 
-import "github.com/gin-gonic/gin"
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+)
 
 // GinHandler godoc
 //
@@ -22,3 +29,90 @@ import "github.com/gin-gonic/gin"
 func (s *P2PServer) GinHandler(c *gin.Context) {
 	s.urlprx.GinHandler(c)
 }
+
+// PacHandler godoc
+//
+//	@Summary		Proxy auto-config script
+//	@Description	Sends the hosts of the routing rules and of the known mesh exits to the
+//	@Description	forward proxy port of this gateway and everything else DIRECT.
+//	@Tags			Proxy
+//	@Produce		application/x-ns-proxy-autoconfig
+//	@Success		200	{string}	string	"PAC script"
+//	@Router			/proxy.pac [get]
+func (s *P2PServer) PacHandler(c *gin.Context) {
+	host, _, err := net.SplitHostPort(c.Request.Host)
+	if err != nil {
+		host = strings.Trim(c.Request.Host, "[]")
+	}
+	_, port := s.opts.ProxyAddr()
+	pac := s.PAC(net.JoinHostPort(host, port))
+
+	// short lifetime so clients pick up new hosts of the mesh
+	c.Header("Cache-Control", "max-age=60")
+	c.Data(http.StatusOK, "application/x-ns-proxy-autoconfig", []byte(pac))
+}
+
+// ResolveHandler godoc
+//
+//	@Summary		Resolve a name through the P2P network
+//	@Description	Asks an exit providing the name for its A, AAAA or CNAME records,
+//	@Description	answers are cached by their TTL.
+//	@Tags			DNS
+//	@Produce		json
+//	@Param			name	query		string	true	"Domain name"
+//	@Param			type	query		string	false	"A, AAAA or CNAME, A and AAAA by default"
+//	@Success		200		{json}		string	"Answers"
+//	@Failure		400		{json}		string	"Invalid query"
+//	@Failure		502		{json}		string	"No proxy nodes available"
+//	@Router			/resolve [get]
+func (s *P2PServer) ResolveHandler(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	types := []uint16{dns.TypeA, dns.TypeAAAA}
+	if t := strings.ToUpper(c.Query("type")); t != "" {
+		qtype, ok := dns.StringToType[t]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid type"})
+			return
+		}
+		types = []uint16{qtype}
+	}
+
+	answers := make([]gin.H, 0)
+	rcode := dns.RcodeSuccess
+	var lastErr error
+	for _, t := range types {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), t)
+		resp, err := s.dns.Exchange(c.Request.Context(), req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			rcode = resp.Rcode
+		}
+		for _, rr := range resp.Answer {
+			hdr := rr.Header()
+			answers = append(answers, gin.H{
+				"name": hdr.Name,
+				"type": dns.TypeToString[hdr.Rrtype],
+				"ttl":  hdr.Ttl,
+				"data": strings.TrimPrefix(rr.String(), hdr.String()),
+			})
+		}
+	}
+
+	if len(answers) == 0 && lastErr != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": lastErr.Error()})
+		return
+	}
+	if len(answers) > 0 {
+		rcode = dns.RcodeSuccess
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "rcode": dns.RcodeToString[rcode], "answers": answers})
+}
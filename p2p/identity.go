@@ -8,6 +8,12 @@ import (
 	"github.com/libp2p/go-libp2p/core/crypto"
 )
 
+// NewIdentity returns a key that is never stored.
+func NewIdentity() (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	return priv, err
+}
+
 func LoadOrCreateIdentity() (crypto.PrivKey, error) {
 	dir := filepath.Dir(os.Args[0])
 	filename := filepath.Join(dir, "node.key")
@@ -0,0 +1,7 @@
+package models
+
+// EvtHostsChanged is emitted on the host event bus when the provided hosts
+// of this node change.
+type EvtHostsChanged struct {
+	Hosts []string
+}
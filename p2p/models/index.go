@@ -0,0 +1,92 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// HostIndex maps the domains of host patterns to the peers announcing them,
+// so the candidates for a host are found without scanning every peer. It
+// is guarded by SrvCtx.MuPeers like the peers map.
+type HostIndex struct {
+	byDomain map[string]map[peer.ID]struct{}
+	// wild holds peers with patterns that have no domain: *, IPs, regexps
+	wild    map[peer.ID]struct{}
+	domains map[peer.ID][]string
+}
+
+func NewHostIndex() *HostIndex {
+	return &HostIndex{
+		byDomain: make(map[string]map[peer.ID]struct{}),
+		wild:     make(map[peer.ID]struct{}),
+		domains:  make(map[peer.ID][]string),
+	}
+}
+
+// Set indexes the host patterns of id, replacing the previous ones.
+func (x *HostIndex) Set(id peer.ID, hosts []string) {
+	x.Remove(id)
+
+	var domains []string
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "!") {
+			continue
+		}
+		domain, ok := utils.PatternDomain(h)
+		if !ok {
+			x.wild[id] = struct{}{}
+			continue
+		}
+		set := x.byDomain[domain]
+		if set == nil {
+			set = make(map[peer.ID]struct{})
+			x.byDomain[domain] = set
+		}
+		set[id] = struct{}{}
+		domains = append(domains, domain)
+	}
+	if len(domains) > 0 {
+		x.domains[id] = domains
+	}
+}
+
+func (x *HostIndex) Remove(id peer.ID) {
+	delete(x.wild, id)
+	for _, domain := range x.domains[id] {
+		if set := x.byDomain[domain]; set != nil {
+			delete(set, id)
+			if len(set) == 0 {
+				delete(x.byDomain, domain)
+			}
+		}
+	}
+	delete(x.domains, id)
+}
+
+// Lookup returns the peers that may serve target, their patterns still
+// have to be matched against it.
+func (x *HostIndex) Lookup(target string) []peer.ID {
+	seen := make(map[peer.ID]struct{}, len(x.wild))
+	ids := make([]peer.ID, 0, len(x.wild))
+	add := func(set map[peer.ID]struct{}) {
+		for id := range set {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	add(x.wild)
+	for name := utils.TargetHost(target); name != ""; {
+		add(x.byDomain[name])
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return ids
+}
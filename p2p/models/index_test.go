@@ -0,0 +1,37 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func BenchmarkHostIndexLookup(b *testing.B) {
+	for _, peers := range []int{1000, 5000} {
+		x := NewHostIndex()
+		for i := 0; i < peers; i++ {
+			hosts := []string{
+				fmt.Sprintf(".domain%d.org", i),
+				fmt.Sprintf("*.cdn%d.net:443", i%100),
+				fmt.Sprintf("site%d.example.com", i),
+			}
+			// a few exits serve everything
+			if i%500 == 0 {
+				hosts = append(hosts, "*")
+			}
+			x.Set(peer.ID(fmt.Sprintf("peer%d", i)), hosts)
+		}
+		targets := []string{
+			"www.domain42.org",
+			"img.cdn7.net:443",
+			"unknown.example.net",
+		}
+
+		b.Run(fmt.Sprint(peers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				x.Lookup(targets[i%len(targets)])
+			}
+		})
+	}
+}
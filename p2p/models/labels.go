@@ -0,0 +1,130 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	maxLabels   = 32
+	maxLabelLen = 128
+)
+
+// CheckLabels reports the first label an exit may not announce: keys are
+// non-empty and neither keys nor values hold the selector separators.
+func CheckLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("too many labels: %d, at most %d", len(labels), maxLabels)
+	}
+	for k, v := range labels {
+		if k == "" || len(k) > maxLabelLen || len(v) > maxLabelLen {
+			return fmt.Errorf("invalid label %q=%q", k, v)
+		}
+		if strings.ContainsAny(k, "=,|?") || strings.ContainsAny(v, ",|") {
+			return fmt.Errorf("invalid label %q=%q: separators =,|? are reserved", k, v)
+		}
+	}
+	return nil
+}
+
+// LabelSelector picks exits by their labels. "key=value" terms are
+// required, "key?=value" terms only rank the exits having them first, and
+// "key=a|b" accepts any of the values. A nil selector accepts every exit.
+type LabelSelector struct {
+	required  []labelTerm
+	preferred []labelTerm
+}
+
+type labelTerm struct {
+	key    string
+	values []string
+}
+
+// ParseLabelSelector parses selector terms, each term may hold several
+// comma separated ones like the X-Tuns-Exit-Labels header does.
+func ParseLabelSelector(terms ...string) (*LabelSelector, error) {
+	var s *LabelSelector
+	for _, term := range terms {
+		for _, t := range strings.Split(term, ",") {
+			t = strings.TrimSpace(t)
+			if t == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(t, "=")
+			key = strings.TrimSpace(key)
+			if !ok || key == "" || key == "?" {
+				return nil, fmt.Errorf("invalid label selector %q", t)
+			}
+			if s == nil {
+				s = &LabelSelector{}
+			}
+
+			lt := labelTerm{}
+			for _, v := range strings.Split(value, "|") {
+				lt.values = append(lt.values, strings.TrimSpace(v))
+			}
+			if k, pref := strings.CutSuffix(key, "?"); pref {
+				lt.key = k
+				s.preferred = append(s.preferred, lt)
+			} else {
+				lt.key = key
+				s.required = append(s.required, lt)
+			}
+		}
+	}
+	return s, nil
+}
+
+// Merge returns a selector with the terms of both selectors.
+func (s *LabelSelector) Merge(o *LabelSelector) *LabelSelector {
+	if s == nil {
+		return o
+	}
+	if o == nil {
+		return s
+	}
+	return &LabelSelector{
+		required:  append(append([]labelTerm{}, s.required...), o.required...),
+		preferred: append(append([]labelTerm{}, s.preferred...), o.preferred...),
+	}
+}
+
+// Matches reports whether labels have every required term.
+func (s *LabelSelector) Matches(labels map[string]string) bool {
+	if s == nil {
+		return true
+	}
+	for _, t := range s.required {
+		if !t.match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rank counts the preferred terms labels have.
+func (s *LabelSelector) Rank(labels map[string]string) int {
+	if s == nil {
+		return 0
+	}
+	rank := 0
+	for _, t := range s.preferred {
+		if t.match(labels) {
+			rank++
+		}
+	}
+	return rank
+}
+
+func (t labelTerm) match(labels map[string]string) bool {
+	v, ok := labels[t.key]
+	if !ok {
+		return false
+	}
+	for _, want := range t.values {
+		if strings.EqualFold(v, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,35 @@
 package models
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/YouROK/tunsgo/p2p/utils"
+)
 
 type PeerInfo struct {
-	PeerID    string    `json:"peer_id"`
-	Hosts     []string  `json:"hosts,omitempty"`
-	Timestamp int64     `json:"timestamp"`
-	LastResp  time.Time `json:"-"`
-	LastSeen  time.Time `json:"-"`
+	PeerID string   `json:"peer_id"`
+	Hosts  []string `json:"hosts,omitempty"`
+	// Labels are free-form facts the exit declares about itself, such as
+	// region=eu or type=residential
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	LastResp  time.Time         `json:"-"`
+	LastSeen  time.Time         `json:"-"`
+	// FirstHand records came from the peer itself rather than relayed
+	FirstHand bool `json:"-"`
+
+	// matcher is Hosts compiled on first use, records are replaced
+	// rather than edited so it never goes stale
+	matcher atomic.Pointer[utils.HostMatcher]
+}
+
+// Matcher returns the compiled host patterns of the peer.
+func (p *PeerInfo) Matcher() *utils.HostMatcher {
+	if m := p.matcher.Load(); m != nil {
+		return m
+	}
+	m := utils.CompileHosts(p.Hosts)
+	p.matcher.Store(m)
+	return m
 }
@@ -0,0 +1,26 @@
+package models
+
+import "github.com/libp2p/go-libp2p/core/peer"
+
+// RepEvent is something a peer did that changes its reputation.
+type RepEvent int
+
+const (
+	RepConnected RepEvent = iota
+	RepProxySuccess
+	RepProxyFailure
+	RepHostpexValid
+	RepHostpexInvalid
+	RepPexUseful
+)
+
+// Reputation scores peers by their events, services get it through SrvCtx
+// without depending on the service keeping the scores.
+type Reputation interface {
+	// Record applies ev to the peer score
+	Record(id peer.ID, ev RepEvent)
+	// Set overrides the score, used to restore scores of a previous run
+	Set(id peer.ID, score float64)
+	// Score returns the current score, higher is better
+	Score(id peer.ID) float64
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// RouteRule is a compiled opts.Route.
+type RouteRule struct {
+	Action   string
+	Peers    []peer.ID
+	Upstream *url.URL
+	Timeout  time.Duration
+	Attempts int
+	Labels   *LabelSelector
+
+	hosts *utils.HostMatcher
+}
+
+// RouteTable is the ordered routing table of a consumer.
+type RouteTable struct {
+	rules []*RouteRule
+}
+
+// defaultRule routes hosts matching no rule the way it always was.
+var defaultRule = &RouteRule{}
+
+func NewRouteTable(routes []opts.Route, upstreams map[string]string) (*RouteTable, error) {
+	t := &RouteTable{}
+	for i, r := range routes {
+		if err := utils.CheckHostPatterns(r.Hosts); err != nil {
+			return nil, fmt.Errorf("route %d: %v", i, err)
+		}
+
+		action, arg, _ := strings.Cut(r.Action, ":")
+		rule := &RouteRule{
+			Action:   action,
+			Timeout:  time.Duration(r.Timeout) * time.Second,
+			Attempts: r.Attempts,
+			hosts:    utils.CompileHosts(r.Hosts),
+		}
+		labels, err := ParseLabelSelector(r.Labels...)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %v", i, err)
+		}
+		rule.Labels = labels
+
+		switch action {
+		case opts.RouteDirect, opts.RouteMesh, opts.RouteBlock, opts.RouteLocalThenMesh:
+		case opts.RouteMeshOnlyPeers:
+			for _, s := range strings.Split(strings.Trim(arg, "[]"), ",") {
+				id, err := peer.Decode(strings.TrimSpace(s))
+				if err != nil {
+					return nil, fmt.Errorf("route %d: invalid peer %q", i, s)
+				}
+				rule.Peers = append(rule.Peers, id)
+			}
+		case opts.RouteUpstream:
+			raw, ok := upstreams[arg]
+			if !ok {
+				return nil, fmt.Errorf("route %d: unknown upstream %q", i, arg)
+			}
+			u, err := url.Parse(raw)
+			if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "socks5" && u.Scheme != "socks5h" {
+				return nil, fmt.Errorf("route %d: invalid upstream %q", i, raw)
+			}
+			rule.Upstream = u
+		default:
+			return nil, fmt.Errorf("route %d: unknown action %q", i, r.Action)
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return t, nil
+}
+
+// Lookup returns the first rule matching target, or the default rule
+// with an empty action.
+func (t *RouteTable) Lookup(target string) *RouteRule {
+	if t != nil {
+		for _, r := range t.rules {
+			if r.hosts.Match(target) {
+				return r
+			}
+		}
+	}
+	return defaultRule
+}
+
+// Rules returns the rules in their order.
+func (t *RouteTable) Rules() []*RouteRule {
+	if t == nil {
+		return nil
+	}
+	return t.rules
+}
+
+// Patterns returns the host patterns of the rule.
+func (r *RouteRule) Patterns() []string {
+	return r.hosts.Patterns()
+}
+
+// AllowsExit reports whether the rule lets id serve as exit.
+func (r *RouteRule) AllowsExit(id peer.ID) bool {
+	if r.Action != opts.RouteMeshOnlyPeers {
+		return true
+	}
+	for _, p := range r.Peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
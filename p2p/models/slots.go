@@ -0,0 +1,35 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	ErrPeerNotAllowed = errors.New("peer not allowed")
+	ErrSlotsBusy      = errors.New("all slots busy")
+)
+
+// Admit decides whether a stream of id is served: the peer has to pass the
+// serve access lists and take one of the slots. On success release gives
+// the slot back after the configured slot sleep.
+func Admit(o *opts.Options, slots chan struct{}, id peer.ID) (release func(), err error) {
+	if !utils.AllowedPeer(o.Access.OnlyServe, o.Access.DenyServe, id) {
+		return nil, ErrPeerNotAllowed
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		return nil, ErrSlotsBusy
+	}
+	return func() {
+		go func() {
+			time.Sleep(time.Duration(o.Server.SlotSleep) * time.Second)
+			<-slots
+		}()
+	}, nil
+}
@@ -2,9 +2,12 @@ package models
 
 import (
 	"context"
+	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/utils"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -17,7 +20,18 @@ type SrvCtx struct {
 	Dht  *dht.IpfsDHT
 
 	Slots chan struct{}
+	Rep   Reputation
+
+	// AddrFilters are networks never announced to other peers
+	AddrFilters []*net.IPNet
+
+	// Hosts is opts.Hosts compiled, swapped as a whole when they change
+	Hosts atomic.Pointer[utils.HostMatcher]
+
+	// Routes decides how this node reaches hosts as a consumer
+	Routes *RouteTable
 
 	Peers   map[peer.ID]*PeerInfo
+	Index   *HostIndex
 	MuPeers sync.RWMutex
 }
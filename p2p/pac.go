@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/utils"
+)
+
+// pacScript looks up a host in the route rules first and in the hosts of
+// the mesh exits then, a match goes to the forward proxy.
+const pacScript = `// Generated by tunsgo, routes and mesh hosts at the time of the request
+var proxy = %s;
+var routes = %s;
+var mesh = %s;
+
+function hit(p, h) {
+	if (p == "*") return true;
+	if (p.charAt(0) == ".") return h == p.substring(1) || dnsDomainIs(h, p);
+	if (p.substring(0, 2) == "*.") return dnsDomainIs(h, p.substring(1));
+	return h == p;
+}
+
+function hitAny(l, h) {
+	for (var i = 0; i < l.length; i++) {
+		if (hit(l[i], h)) return true;
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	for (var i = 0; i < routes.length; i++) {
+		if (hitAny(routes[i][1], host) && !hitAny(routes[i][2], host)) {
+			return routes[i][0] ? proxy : "DIRECT";
+		}
+	}
+	for (var i = 0; i < mesh.length; i++) {
+		if (hitAny(mesh[i][0], host) && !hitAny(mesh[i][1], host)) return proxy;
+	}
+	return "DIRECT";
+}
+`
+
+// PAC returns a proxy auto-config script sending the hosts the route rules
+// or the mesh exits serve to the forward proxy at addr and the rest DIRECT.
+// Only name patterns are carried, ports are dropped from them, and an exit
+// providing any host is left out so the script stays selective.
+func (s *P2PServer) PAC(addr string) string {
+	routes := [][]any{}
+	for _, rule := range s.srvctx.Routes.Rules() {
+		allow, deny := pacPatterns(rule.Patterns(), true)
+		routes = append(routes, []any{rule.Action != opts.RouteDirect, allow, deny})
+	}
+
+	mesh := [][][]string{}
+	seen := make(map[string]bool)
+	s.srvctx.MuPeers.RLock()
+	for id, info := range s.srvctx.Peers {
+		if !utils.AllowedPeer(s.opts.Access.OnlyUse, s.opts.Access.DenyUse, id) {
+			continue
+		}
+		allow, deny := pacPatterns(info.Matcher().Patterns(), false)
+		if len(allow) == 0 {
+			continue
+		}
+		key := strings.Join(allow, ",") + "!" + strings.Join(deny, ",")
+		if !seen[key] {
+			seen[key] = true
+			mesh = append(mesh, [][]string{allow, deny})
+		}
+	}
+	s.srvctx.MuPeers.RUnlock()
+
+	// a stable order keeps the script cacheable while the mesh is unchanged
+	slices.SortFunc(mesh, func(a, b [][]string) int {
+		return strings.Compare(strings.Join(a[0], ","), strings.Join(b[0], ","))
+	})
+
+	proxy, _ := json.Marshal("PROXY " + addr + "; DIRECT")
+	r, _ := json.Marshal(routes)
+	m, _ := json.Marshal(mesh)
+	return fmt.Sprintf(pacScript, proxy, r, m)
+}
+
+// pacPatterns splits patterns into the names to allow and to deny. A
+// negation with a port is dropped since it only excludes that port, * is
+// kept only when wildcard is set.
+func pacPatterns(patterns []string, wildcard bool) (allow, deny []string) {
+	allow, deny = []string{}, []string{}
+	for _, p := range patterns {
+		if neg, ok := strings.CutPrefix(p, "!"); ok {
+			if name, port, ok := utils.NamePattern(neg); ok && port == "" {
+				deny = append(deny, name)
+			}
+			continue
+		}
+		if h, _, _ := strings.Cut(p, ":"); h == "*" {
+			if wildcard {
+				allow = append(allow, "*")
+			}
+			continue
+		}
+		if name, _, ok := utils.NamePattern(p); ok && !strings.HasSuffix(name, opts.TunsSuffix) {
+			allow = append(allow, name)
+		}
+	}
+	return allow, deny
+}
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// relayOptions builds the circuit relay client, the relay service with the
+// configured limits and AutoRelay with the trusted static relays.
+func relayOptions(o *opts.Options) ([]libp2p.Option, error) {
+	cfg := o.Relay
+
+	static := make([]multiaddr.Multiaddr, 0, len(cfg.StaticRelays))
+	for _, s := range cfg.StaticRelays {
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static relay %q: %w", s, err)
+		}
+		static = append(static, addr)
+	}
+	staticRelays, err := peer.AddrInfosFromP2pAddrs(static...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid static relays: %w", err)
+	}
+
+	res := []libp2p.Option{
+		libp2p.EnableRelay(),
+		libp2p.EnableAutoRelayWithStaticRelays(staticRelays),
+	}
+
+	if o.RelayService() {
+		resources := relay.DefaultResources()
+		resources.ReservationTTL = time.Duration(cfg.ReservationTTL) * time.Second
+		resources.MaxReservations = cfg.MaxReservations
+		resources.MaxCircuits = cfg.MaxCircuits
+		resources.MaxReservationsPerIP = cfg.MaxReservationsPerIP
+		resources.MaxReservationsPerASN = cfg.MaxReservationsPerASN
+		resources.Limit = &relay.RelayLimit{
+			Duration: time.Duration(cfg.CircuitDuration) * time.Second,
+			Data:     cfg.CircuitData,
+		}
+		res = append(res, libp2p.EnableRelayService(relay.WithResources(resources)))
+	}
+
+	return res, nil
+}
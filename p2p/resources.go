@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+type ResourceStatus struct {
+	System    network.ScopeStat            `json:"system"`
+	Transient network.ScopeStat            `json:"transient"`
+	Protocols map[string]network.ScopeStat `json:"protocols"`
+	Blocked   map[string]int64             `json:"blocked"`
+}
+
+// blockCounter counts the resource manager refusals by event and scope.
+type blockCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (b *blockCounter) ConsumeEvent(evt rcmgr.TraceEvt) {
+	switch evt.Type {
+	case rcmgr.TraceBlockAddStreamEvt, rcmgr.TraceBlockAddConnEvt, rcmgr.TraceBlockReserveMemoryEvt:
+	default:
+		return
+	}
+
+	b.mu.Lock()
+	b.counts[string(evt.Type)+" "+scopeName(evt.Name)]++
+	b.mu.Unlock()
+}
+
+func (b *blockCounter) snapshot() map[string]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make(map[string]int64, len(b.counts))
+	for k, v := range b.counts {
+		res[k] = v
+	}
+	return res
+}
+
+// scopeName folds per peer and per connection scopes into one counter, so
+// the counters stay few: "peer", "protocol:/tunsgo/pex/1.0.0", "system"...
+func scopeName(name string) string {
+	if strings.HasPrefix(name, "protocol:") {
+		if idx := strings.Index(name, ".peer:"); idx > -1 {
+			return name[:idx] + ".peer"
+		}
+		return name
+	}
+	if idx := strings.IndexAny(name, ":-"); idx > -1 {
+		return name[:idx]
+	}
+	return name
+}
+
+func limitVal(v int) rcmgr.LimitVal {
+	return rcmgr.LimitVal(v)
+}
+
+func resourceLimits(l opts.ResourceLimits) rcmgr.ResourceLimits {
+	mem := rcmgr.LimitVal64(l.MemoryMB)
+	if l.MemoryMB > 0 {
+		mem = rcmgr.LimitVal64(l.MemoryMB << 20)
+	}
+	return rcmgr.ResourceLimits{
+		Streams:         limitVal(l.Streams),
+		StreamsInbound:  limitVal(l.StreamsInbound),
+		StreamsOutbound: limitVal(l.StreamsOutbound),
+		Conns:           limitVal(l.Conns),
+		ConnsInbound:    limitVal(l.ConnsInbound),
+		ConnsOutbound:   limitVal(l.ConnsOutbound),
+		FD:              limitVal(l.FD),
+		Memory:          mem,
+	}
+}
+
+// resourceManager builds the libp2p resource manager from the autoscaled
+// defaults overridden by the config. Zero values keep the defaults, -1 is
+// unlimited.
+func resourceManager(o *opts.Options) (libp2p.Option, network.ResourceManager, *blockCounter, error) {
+	scaling := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&scaling)
+
+	cfg := rcmgr.PartialLimitConfig{
+		System:      resourceLimits(o.Resources.System),
+		PeerDefault: resourceLimits(o.Resources.Peer),
+		Protocol:    make(map[protocol.ID]rcmgr.ResourceLimits),
+	}
+	for proto, l := range o.Resources.Protocols {
+		cfg.Protocol[protocol.ID(proto)] = resourceLimits(l)
+	}
+
+	counter := &blockCounter{counts: make(map[string]int64)}
+	limiter := rcmgr.NewFixedLimiter(cfg.Build(scaling.AutoScale()))
+	rm, err := rcmgr.NewResourceManager(limiter, rcmgr.WithTraceReporter(counter))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return libp2p.ResourceManager(rm), rm, counter, nil
+}
+
+func (s *P2PServer) resourcesStatus() *ResourceStatus {
+	st := &ResourceStatus{
+		Protocols: make(map[string]network.ScopeStat),
+		Blocked:   s.rmBlocks.snapshot(),
+	}
+
+	s.rm.ViewSystem(func(scope network.ResourceScope) error {
+		st.System = scope.Stat()
+		return nil
+	})
+	s.rm.ViewTransient(func(scope network.ResourceScope) error {
+		st.Transient = scope.Stat()
+		return nil
+	})
+	for _, proto := range s.host.Mux().Protocols() {
+		if !strings.HasPrefix(string(proto), "/tunsgo/") {
+			continue
+		}
+		s.rm.ViewProtocol(proto, func(scope network.ProtocolScope) error {
+			st.Protocols[string(proto)] = scope.Stat()
+			return nil
+		})
+	}
+	return st
+}
@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -10,9 +11,20 @@ import (
 	"github.com/YouROK/tunsgo/p2p/models"
 	"github.com/YouROK/tunsgo/p2p/services"
 	"github.com/YouROK/tunsgo/p2p/services/discover"
+	"github.com/YouROK/tunsgo/p2p/services/fwdproxy"
+	"github.com/YouROK/tunsgo/p2p/services/hostlist"
 	"github.com/YouROK/tunsgo/p2p/services/hostpex"
+	"github.com/YouROK/tunsgo/p2p/services/localdns"
+	"github.com/YouROK/tunsgo/p2p/services/mdns"
+	"github.com/YouROK/tunsgo/p2p/services/meshdns"
 	"github.com/YouROK/tunsgo/p2p/services/pex"
+	"github.com/YouROK/tunsgo/p2p/services/publish"
+	"github.com/YouROK/tunsgo/p2p/services/registry"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/YouROK/tunsgo/p2p/services/sni"
+	"github.com/YouROK/tunsgo/p2p/services/udprelay"
 	"github.com/YouROK/tunsgo/p2p/services/urlproxy"
+	"github.com/YouROK/tunsgo/p2p/utils"
 	"github.com/YouROK/tunsgo/version"
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
@@ -22,8 +34,8 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
-	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
 )
 
@@ -36,6 +48,12 @@ type P2PServer struct {
 	cm   *connmgr.BasicConnMgr
 	cId  cid.Cid
 
+	rm       network.ResourceManager
+	rmBlocks *blockCounter
+
+	netState   NetworkStatus
+	muNetState sync.RWMutex
+
 	slots chan struct{}
 
 	opts *opts.Options
@@ -44,6 +62,8 @@ type P2PServer struct {
 	srvctx *models.SrvCtx
 
 	urlprx *urlproxy.UrlProxy
+	udp    *udprelay.UdpRelay
+	dns    *meshdns.MeshDns
 }
 
 func NewP2PServer(opts *opts.Options) (*P2PServer, error) {
@@ -51,7 +71,11 @@ func NewP2PServer(opts *opts.Options) (*P2PServer, error) {
 	log.Println("[P2P Server] Version:", version.Version)
 	log.Println("[P2P Server] Provide hosts:", opts.Hosts)
 
-	key, err := LoadOrCreateIdentity()
+	load := LoadOrCreateIdentity
+	if opts.Ephemeral {
+		load = NewIdentity
+	}
+	key, err := load()
 	if err != nil {
 		return nil, err
 	}
@@ -65,6 +89,52 @@ func NewP2PServer(opts *opts.Options) (*P2PServer, error) {
 	if opts.Server.SlotSleep > 300 { //max sleep 5 min
 		opts.Server.SlotSleep = 0
 	}
+	if opts.State.SaveInterval < 10 { // min save every 10 sec
+		opts.State.SaveInterval = 10
+	}
+	if opts.DNS.TTL < 1 { // min dns ttl 1 sec
+		opts.DNS.TTL = 1
+	}
+	if opts.UDP.IdleTimeout < 5 { // min udp idle 5 sec
+		opts.UDP.IdleTimeout = 5
+	}
+	if err = opts.CheckRole(); err != nil {
+		return nil, err
+	}
+	hosts, hostLists, err := hostlist.Expand(opts.Hosts, opts.ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+	if err = utils.CheckHostPatterns(hosts); err != nil {
+		return nil, err
+	}
+	if len(hostLists) > 0 {
+		log.Println("[P2P Server] Provide hosts from lists, patterns:", len(hosts))
+	}
+	routes, err := models.NewRouteTable(opts.Routes, opts.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	if opts.HostsReload < 1 { // min reload check every 1 sec
+		opts.HostsReload = 1
+	}
+	if err = utils.CheckHostPatterns(opts.DNS.Hosts); err != nil {
+		return nil, err
+	}
+	for _, rule := range opts.MultiHop.Rules {
+		if err = utils.CheckHostPatterns(rule.Hosts); err != nil {
+			return nil, err
+		}
+	}
+	if err = models.CheckLabels(opts.Labels); err != nil {
+		return nil, err
+	}
+	profile := opts.Profile()
+	log.Println("[P2P Server] Role:", opts.Role)
+	if opts.P2P.LanOnly { // without bootstrap mdns is the only way to find peers
+		opts.P2P.MDNS = true
+		log.Println("[P2P Server] LAN only mode: DHT bootstrap and relays are disabled")
+	}
 
 	ctx := context.Background()
 
@@ -77,37 +147,85 @@ func NewP2PServer(opts *opts.Options) (*P2PServer, error) {
 		return nil, err
 	}
 
-	relayResources := relay.DefaultResources()
-	if relayResources.Limit != nil {
-		relayResources.Limit.Duration = 2 * time.Minute
-		relayResources.Limit.Data = 1 << 21 //2 mb
+	transports, err := transportOptions(opts)
+	if err != nil {
+		cm.Close()
+		return nil, err
+	}
+
+	addrFactory, addrFilters, err := addrsFactory(opts)
+	if err != nil {
+		cm.Close()
+		return nil, err
+	}
+
+	rmOpt, rm, rmBlocks, err := resourceManager(opts)
+	if err != nil {
+		cm.Close()
+		return nil, err
 	}
 
 	optsLp2p := []libp2p.Option{
+		rmOpt,
 		libp2p.Identity(key),
-		libp2p.ChainOptions(libp2p.DefaultPrivateTransports),
+		libp2p.ChainOptions(transports...),
 		libp2p.Security(tls.ID, tls.New),
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/tcp/0",
-		),
+		libp2p.AddrsFactory(addrFactory),
 		libp2p.ConnectionManager(cm),
-		libp2p.NATPortMap(),
+	}
 
-		libp2p.EnableRelay(),
-		libp2p.EnableRelayService(relay.WithResources(relayResources)),
-		libp2p.EnableAutoRelayWithStaticRelays(nil),
-		libp2p.EnableNATService(),
-		libp2p.EnableHolePunching(),
+	switch opts.P2P.ForceReachability {
+	case "":
+	case "public":
+		optsLp2p = append(optsLp2p, libp2p.ForceReachabilityPublic())
+	case "private":
+		optsLp2p = append(optsLp2p, libp2p.ForceReachabilityPrivate())
+	default:
+		rm.Close()
+		cm.Close()
+		return nil, fmt.Errorf("unknown force_reachability %q", opts.P2P.ForceReachability)
+	}
+
+	if opts.P2P.LanOnly {
+		optsLp2p = append(optsLp2p,
+			libp2p.DisableRelay(),
+		)
+	} else {
+		relayOpts, err := relayOptions(opts)
+		if err != nil {
+			rm.Close()
+			cm.Close()
+			return nil, err
+		}
+		optsLp2p = append(optsLp2p, relayOpts...)
+		optsLp2p = append(optsLp2p,
+			libp2p.NATPortMap(),
+			libp2p.EnableNATService(),
+			libp2p.EnableHolePunching(),
+		)
 	}
 
 	h, err := libp2p.New(optsLp2p...)
 	if err != nil {
+		rm.Close()
 		cm.Close()
 		return nil, err
 	}
 	log.Println("[P2P] ID", h.ID().String())
 
-	idht, err := dht.New(ctx, h, dht.Mode(dht.ModeAuto))
+	// in auto modes the DHT follows reachability and runs as client when private
+	dhtMode := dht.ModeAuto
+	if profile.DHTServer {
+		dhtMode = dht.ModeAutoServer
+	}
+	dhtOpts := []dht.Option{dht.Mode(dhtMode)}
+	if len(addrFilters) > 0 {
+		dhtOpts = append(dhtOpts, dht.AddressFilter(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return utils.FilterAddrs(addrs, addrFilters)
+		}))
+	}
+
+	idht, err := dht.New(ctx, h, dhtOpts...)
 	if err != nil {
 		cm.Close()
 		return nil, err
@@ -122,10 +240,16 @@ func NewP2PServer(opts *opts.Options) (*P2PServer, error) {
 	c, _ := pref.Sum([]byte(Rendezvous))
 
 	srv := &P2PServer{
-		host:  h,
-		dht:   idht,
-		ctx:   ctx,
-		cm:    cm,
+		host:     h,
+		dht:      idht,
+		ctx:      ctx,
+		cm:       cm,
+		rm:       rm,
+		rmBlocks: rmBlocks,
+		netState: NetworkStatus{
+			Reachability:   network.ReachabilityUnknown.String(),
+			NATDeviceTypes: make(map[string]string),
+		},
 		opts:  opts,
 		cId:   c,
 		slots: make(chan struct{}, opts.Server.Slots),
@@ -134,23 +258,72 @@ func NewP2PServer(opts *opts.Options) (*P2PServer, error) {
 
 	go srv.startDiscovery()
 
+	rep := reputation.NewReputation(srv.host, srv.ctx)
 	srvctx := &models.SrvCtx{
 		Host:    srv.host,
 		Opts:    srv.opts,
 		Ctx:     srv.ctx,
 		Dht:     srv.dht,
 		Slots:   srv.slots,
+		Rep:     rep,
 		Peers:   make(map[peer.ID]*models.PeerInfo),
+		Routes:  routes,
+		Index:   models.NewHostIndex(),
 		MuPeers: sync.RWMutex{},
+
+		AddrFilters: addrFilters,
 	}
+	srvctx.Hosts.Store(utils.CompileHosts(hosts))
 
 	srv.srvctx = srvctx
 
-	srv.urlprx = urlproxy.NewUrlProxy(srvctx)
-	srv.srvc.AddService(srv.urlprx)
-	srv.srvc.AddService(hostpex.NewHostPex(srvctx))
+	srv.srvc.AddService(rep)
+	if len(hostLists) > 0 {
+		srv.srvc.AddService(hostlist.NewHostList(srvctx, hostLists))
+	}
+	if profile.Consume || profile.Exit || len(opts.Publish) > 0 {
+		srv.urlprx = urlproxy.NewUrlProxy(srvctx)
+		if profile.Exit {
+			srv.srvc.AddService(srv.urlprx)
+		} else {
+			srv.srvc.AddClientService(srv.urlprx)
+		}
+		srv.udp = udprelay.NewUdpRelay(srvctx, srv.urlprx.Candidates)
+		if profile.Exit {
+			srv.srvc.AddService(srv.udp)
+		} else {
+			srv.srvc.AddClientService(srv.udp)
+		}
+		srv.dns = meshdns.NewMeshDns(srvctx, srv.urlprx.Candidates)
+		if profile.Exit {
+			srv.srvc.AddService(srv.dns)
+		} else {
+			srv.srvc.AddClientService(srv.dns)
+		}
+		srv.srvc.AddService(hostpex.NewHostPex(srvctx))
+	}
+	if len(opts.Publish) > 0 {
+		srv.srvc.AddService(publish.NewPublish(srvctx))
+	}
 	srv.srvc.AddService(pex.NewPex(srvctx))
-	srv.srvc.AddService(discover.NewDiscover(srvctx))
+	if profile.Consume {
+		srv.srvc.AddService(discover.NewDiscover(srvctx))
+	}
+	if opts.Server.SNIPort != "" && profile.Gateway {
+		srv.srvc.AddService(sni.NewSni(srvctx, srv.urlprx.Dial))
+	}
+	if opts.Server.ProxyPort != "" && profile.Gateway {
+		srv.srvc.AddService(fwdproxy.NewFwdProxy(srvctx, srv.urlprx.Dial))
+	}
+	if opts.DNS.Listen != "" && profile.Gateway {
+		srv.srvc.AddService(localdns.NewLocalDns(srvctx))
+	}
+	if opts.P2P.MDNS {
+		srv.srvc.AddService(mdns.NewMdns(srvctx))
+	}
+	if opts.State.Dir != "" {
+		srv.srvc.AddService(registry.NewRegistry(srvctx))
+	}
 
 	err = srv.srvc.Start()
 	if err != nil {
@@ -175,6 +348,8 @@ func (s *P2PServer) Stop() {
 func (s *P2PServer) watchNetworkStatus() {
 	sub, err := s.host.EventBus().Subscribe([]interface{}{
 		new(event.EvtLocalReachabilityChanged),
+		new(event.EvtNATDeviceTypeChanged),
+		new(event.EvtAutoRelayAddrsUpdated),
 	})
 	if err != nil {
 		log.Printf("[NET] Failed to subscribe to reachability events: %v", err)
@@ -192,17 +367,35 @@ func (s *P2PServer) watchNetworkStatus() {
 					return
 				}
 
+				s.muNetState.Lock()
 				switch evt := e.(type) {
 				case event.EvtLocalReachabilityChanged:
+					// libp2p runs the relay service and the DHT server only while
+					// public, so both stop being advertised as soon as we are private
+					s.netState.Reachability = evt.Reachability.String()
 					switch evt.Reachability {
 					case network.ReachabilityPublic:
-						log.Println("[NET] Reachability changed: PUBLIC. Node is now operating as a Relay Hop")
+						if s.opts.RelayService() {
+							log.Println("[NET] Reachability changed: PUBLIC. Node is now operating as a Relay Hop")
+						} else {
+							log.Println("[NET] Reachability changed: PUBLIC")
+						}
 					case network.ReachabilityPrivate:
 						log.Println("[NET] Reachability changed: PRIVATE. Node is operating behind NAT (client mode)")
 					case network.ReachabilityUnknown:
 						log.Println("[NET] Reachability changed: UNKNOWN. Determining network status...")
 					}
+				case event.EvtNATDeviceTypeChanged:
+					s.netState.NATDeviceTypes[evt.TransportProtocol.String()] = evt.NatDeviceType.String()
+					log.Printf("[NET] NAT device type for %s: %s", evt.TransportProtocol, evt.NatDeviceType)
+				case event.EvtAutoRelayAddrsUpdated:
+					s.netState.RelayAddrs = s.netState.RelayAddrs[:0]
+					for _, a := range evt.RelayAddrs {
+						s.netState.RelayAddrs = append(s.netState.RelayAddrs, a.String())
+					}
+					log.Printf("[NET] Relay addresses updated, count: %d", len(evt.RelayAddrs))
 				}
+				s.muNetState.Unlock()
 			case <-s.ctx.Done():
 				log.Println("[NET] Stopping network reachability")
 				return
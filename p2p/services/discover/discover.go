@@ -8,6 +8,7 @@ import (
 
 	"github.com/YouROK/tunsgo/opts"
 	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -22,6 +23,7 @@ type Discover struct {
 	dht     *dht.IpfsDHT
 	peers   map[peer.ID]*models.PeerInfo
 	muPeers *sync.RWMutex
+	rep     models.Reputation
 }
 
 func NewDiscover(c *models.SrvCtx) *Discover {
@@ -32,6 +34,7 @@ func NewDiscover(c *models.SrvCtx) *Discover {
 		dht:     c.Dht,
 		peers:   c.Peers,
 		muPeers: &c.MuPeers,
+		rep:     c.Rep,
 	}
 }
 
@@ -128,7 +131,5 @@ func (s *Discover) connect(pid peer.ID) {
 	s.muPeers.Unlock()
 	log.Printf("[DISCOVER] Successfully connected to %s with hosts %v", pid, hosts)
 
-	s.host.ConnManager().UpsertTag(pid, "tuns-node", func(current int) int {
-		return 100
-	})
+	s.rep.Record(pid, reputation.Connected)
 }
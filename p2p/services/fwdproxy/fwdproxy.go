@@ -0,0 +1,176 @@
+package fwdproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DialFunc opens a connection to addr through the mesh.
+type DialFunc func(ctx context.Context, addr string, pin peer.ID) (net.Conn, error)
+
+// hopHeaders are meaningful for a single connection only and are not
+// passed to the target.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// FwdProxy is a classic forward proxy for browsers and OS proxy settings:
+// CONNECT tunnels and absolute-URI HTTP requests, both routed like the
+// proxy handler routes the host.
+type FwdProxy struct {
+	opts *opts.Options
+	ctx  context.Context
+	dial DialFunc
+
+	transport *http.Transport
+	srv       *http.Server
+}
+
+func NewFwdProxy(c *models.SrvCtx, dial DialFunc) *FwdProxy {
+	p := &FwdProxy{
+		opts: c.Opts,
+		ctx:  c.Ctx,
+		dial: dial,
+	}
+	p.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dial(ctx, addr, "")
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+	return p
+}
+
+func (p *FwdProxy) Start() error {
+	addr, _ := p.opts.ProxyAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.srv = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := p.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("[FwdProxy] Serve error:", err)
+		}
+	}()
+
+	log.Println("[FwdProxy] Service started on", ln.Addr())
+	return nil
+}
+
+func (p *FwdProxy) Stop() {
+	log.Println("[FwdProxy] Service stoping...")
+	if p.srv != nil {
+		p.srv.Close()
+	}
+	p.transport.CloseIdleConnections()
+}
+
+func (p *FwdProxy) Name() string {
+	return "FwdProxy"
+}
+
+func (p *FwdProxy) ProtocolID() protocol.ID {
+	return ""
+}
+
+func (p *FwdProxy) HandleStream(stream network.Stream) {
+	stream.Close()
+}
+
+func (p *FwdProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "absolute http:// URI or CONNECT expected", http.StatusBadRequest)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("[FwdProxy] %s: %v", r.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *FwdProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	addr := r.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	remote, err := p.dial(ctx, addr, "")
+	cancel()
+	if err != nil {
+		log.Printf("[FwdProxy] %s: %v", addr, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// the client may have sent more than the request already
+	utils.Splice(utils.WithReader(conn, rw.Reader), remote)
+}
@@ -0,0 +1,149 @@
+package hostlist
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxDepth stops lists that include each other.
+const maxDepth = 8
+
+// Expand resolves the file: and dir: entries of provided_hosts into their
+// patterns and returns them with the paths to watch for changes.
+//
+// A list file holds one pattern per line, # starts a comment and [name]
+// starts a category. file:path#name takes only the patterns of category
+// name, dir:path takes every file of the directory. Lists may include other
+// lists the same way, relative paths are resolved next to the including
+// list, or against base, the config directory, for provided_hosts.
+func Expand(entries []string, base string) ([]string, []string, error) {
+	e := &expander{seen: make(map[string]bool)}
+	if err := e.expand(entries, base, 0); err != nil {
+		return nil, nil, err
+	}
+	return e.hosts, e.watched, nil
+}
+
+type expander struct {
+	hosts   []string
+	watched []string
+	seen    map[string]bool
+}
+
+func (e *expander) expand(entries []string, base string, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("host lists nested deeper than %d", maxDepth)
+	}
+
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry, "file:"):
+			path, category := splitCategory(strings.TrimPrefix(entry, "file:"))
+			if err := e.expandFile(resolve(base, path), category, depth); err != nil {
+				return err
+			}
+		case strings.HasPrefix(entry, "dir:"):
+			if err := e.expandDir(resolve(base, strings.TrimPrefix(entry, "dir:")), depth); err != nil {
+				return err
+			}
+		default:
+			if !e.seen[entry] {
+				e.seen[entry] = true
+				e.hosts = append(e.hosts, entry)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *expander) expandFile(path, category string, depth int) error {
+	entries, err := readList(path, category)
+	if err != nil {
+		return err
+	}
+	e.watched = append(e.watched, path)
+	return e.expand(entries, filepath.Dir(path), depth+1)
+}
+
+func (e *expander) expandDir(dir string, depth int) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	e.watched = append(e.watched, dir)
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if err = e.expandFile(filepath.Join(dir, f.Name()), "", depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readList reads the entries of a list file, only those of category when
+// it is set.
+func readList(path, category string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := stripComment(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if category == "" || current == category {
+			entries = append(entries, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// stripComment drops a # comment, a # inside a pattern like a regexp is
+// kept unless it follows a space.
+func stripComment(line string) string {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		if j := strings.Index(line[i:], "#"); j >= 0 {
+			line = line[:i+j]
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+func splitCategory(path string) (string, string) {
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+func resolve(base, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
@@ -0,0 +1,135 @@
+package hostlist
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// HostList reloads provided_hosts when the list files it includes change
+// and emits models.EvtHostsChanged so the new hosts get announced.
+type HostList struct {
+	host host.Host
+	opts *opts.Options
+	ctx  context.Context
+
+	hosts   *atomic.Pointer[utils.HostMatcher]
+	watched []string
+	sig     string
+	emitter event.Emitter
+}
+
+func NewHostList(c *models.SrvCtx, watched []string) *HostList {
+	return &HostList{
+		host:    c.Host,
+		opts:    c.Opts,
+		ctx:     c.Ctx,
+		hosts:   &c.Hosts,
+		watched: watched,
+	}
+}
+
+func (h *HostList) Start() error {
+	emitter, err := h.host.EventBus().Emitter(new(models.EvtHostsChanged))
+	if err != nil {
+		return err
+	}
+	h.emitter = emitter
+	h.sig = signature(h.watched)
+
+	go h.watchLoop()
+
+	log.Println("[HOSTLIST] Service started, watching", len(h.watched), "lists")
+	return nil
+}
+
+func (h *HostList) Stop() {
+	log.Println("[HOSTLIST] Service stoping...")
+	if h.emitter != nil {
+		h.emitter.Close()
+	}
+}
+
+func (h *HostList) Name() string {
+	return "HostList"
+}
+
+func (h *HostList) ProtocolID() protocol.ID {
+	return ""
+}
+
+func (h *HostList) HandleStream(stream network.Stream) {
+	stream.Close()
+}
+
+func (h *HostList) watchLoop() {
+	ticker := time.NewTicker(time.Duration(h.opts.HostsReload) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			h.reload()
+		}
+	}
+}
+
+// reload re-reads the lists when one of them changed, broken lists keep
+// the hosts we already serve.
+func (h *HostList) reload() {
+	sig := signature(h.watched)
+	if sig == h.sig {
+		return
+	}
+	h.sig = sig
+
+	hosts, watched, err := Expand(h.opts.Hosts, h.opts.ConfigDir)
+	if err == nil {
+		err = utils.CheckHostPatterns(hosts)
+	}
+	if err != nil {
+		log.Println("[HOSTLIST] Reload error, keeping the current hosts:", err)
+		return
+	}
+
+	h.watched = watched
+	h.sig = signature(watched)
+	if slices.Equal(hosts, h.hosts.Load().Patterns()) {
+		return
+	}
+
+	h.hosts.Store(utils.CompileHosts(hosts))
+	log.Println("[HOSTLIST] Provided hosts reloaded, patterns:", len(hosts))
+	h.emitter.Emit(models.EvtHostsChanged{Hosts: hosts})
+}
+
+// signature sums up the state of the watched files, a directory changes
+// its mtime when files are added or removed.
+func signature(paths []string) string {
+	var sb strings.Builder
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			fmt.Fprintf(&sb, "%s:missing;", filepath.Clean(p))
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d;", filepath.Clean(p), fi.ModTime().UnixNano(), fi.Size())
+	}
+	return sb.String()
+}
@@ -0,0 +1,223 @@
+package hostpex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Hostpex 2.0.0 wire format, all numbers are unsigned varints:
+//
+//	request:  count, count*8 bytes of record keys, len, own record (len 0 if none)
+//	response: count, count*(len, record), held count, held count*8 bytes of
+//	          the requested keys the responder still has (missing from old nodes)
+//	record:   len, peer id, timestamp, hosts count, hosts count*(len, host),
+//	          labels count, labels count*(len, key, len, value)
+//
+// Decoders ignore bytes left at the end of a record, so new fields can be
+// appended without a protocol bump.
+
+const (
+	maxDigest    = 1 << 14
+	maxRecordLen = 1 << 16
+	maxHosts     = 1 << 10
+)
+
+var errTooLarge = errors.New("hostpex: frame too large")
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// recordKey identifies a record version: it changes whenever the origin
+// node republishes its hosts with a new timestamp.
+func recordKey(pid peer.ID, timestamp int64) uint64 {
+	h := sha256.New()
+	h.Write([]byte(pid))
+	binary.Write(h, binary.BigEndian, timestamp)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func encodeRecord(pid peer.ID, info *models.PeerInfo) []byte {
+	buf := appendString(nil, string(pid))
+	buf = binary.AppendUvarint(buf, uint64(info.Timestamp))
+	buf = binary.AppendUvarint(buf, uint64(len(info.Hosts)))
+	for _, h := range info.Hosts {
+		buf = appendString(buf, h)
+	}
+	if len(info.Labels) > 0 {
+		buf = binary.AppendUvarint(buf, uint64(len(info.Labels)))
+		for k, v := range info.Labels {
+			buf = appendString(buf, k)
+			buf = appendString(buf, v)
+		}
+	}
+	return buf
+}
+
+func readBytes(r byteReader, limit uint64) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, errTooLarge
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+func decodeRecord(data []byte) (*models.PeerInfo, error) {
+	r := bytes.NewReader(data)
+
+	id, err := readBytes(r, maxRecordLen)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := peer.IDFromBytes(id)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxHosts {
+		return nil, errTooLarge
+	}
+
+	info := &models.PeerInfo{
+		PeerID:    pid.String(),
+		Timestamp: int64(ts),
+		Hosts:     make([]string, 0, count),
+	}
+	for i := uint64(0); i < count; i++ {
+		host, err := readBytes(r, maxRecordLen)
+		if err != nil {
+			return nil, err
+		}
+		info.Hosts = append(info.Hosts, string(host))
+	}
+
+	// records of older nodes end after the hosts
+	if r.Len() == 0 {
+		return info, nil
+	}
+	count, err = binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxHosts {
+		return nil, errTooLarge
+	}
+	info.Labels = make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes(r, maxRecordLen)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readBytes(r, maxRecordLen)
+		if err != nil {
+			return nil, err
+		}
+		info.Labels[string(key)] = string(value)
+	}
+	return info, nil
+}
+
+func appendKeys(buf []byte, keys []uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = binary.BigEndian.AppendUint64(buf, k)
+	}
+	return buf
+}
+
+func readKeys(r byteReader) ([]uint64, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxDigest {
+		return nil, errTooLarge
+	}
+
+	keys := make([]uint64, 0, count)
+	var k [8]byte
+	for i := uint64(0); i < count; i++ {
+		if _, err = io.ReadFull(r, k[:]); err != nil {
+			return nil, err
+		}
+		keys = append(keys, binary.BigEndian.Uint64(k[:]))
+	}
+	return keys, nil
+}
+
+func writeRequest(w io.Writer, keys []uint64, own []byte) error {
+	buf := appendKeys(nil, keys)
+	buf = binary.AppendUvarint(buf, uint64(len(own)))
+	buf = append(buf, own...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRequest(r byteReader) (map[uint64]bool, []byte, error) {
+	list, err := readKeys(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make(map[uint64]bool, len(list))
+	for _, k := range list {
+		keys[k] = true
+	}
+
+	own, err := readBytes(r, maxRecordLen)
+	return keys, own, err
+}
+
+func writeRecords(w io.Writer, records [][]byte, held []uint64) error {
+	buf := binary.AppendUvarint(nil, uint64(len(records)))
+	for _, rec := range records {
+		buf = binary.AppendUvarint(buf, uint64(len(rec)))
+		buf = append(buf, rec...)
+	}
+	buf = appendKeys(buf, held)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRecords(r byteReader, limit int) ([][]byte, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(limit) {
+		return nil, errTooLarge
+	}
+
+	records := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		rec, err := readBytes(r, maxRecordLen)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -1,15 +1,21 @@
 package hostpex
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"log"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/YouROK/tunsgo/opts"
 	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/publish"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/YouROK/tunsgo/p2p/utils"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -18,41 +24,62 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
+const (
+	ProtocolV1 protocol.ID = "/tunsgo/hostpex/1.0.0"
+	ProtocolV2 protocol.ID = "/tunsgo/hostpex/2.0.0"
+)
+
 type HostPex struct {
 	host host.Host
 	opts *opts.Options
 	ctx  context.Context
 	dht  *dht.IpfsDHT
 
+	hosts *atomic.Pointer[utils.HostMatcher]
+
 	peers   map[peer.ID]*models.PeerInfo
+	index   *models.HostIndex
 	muPeers *sync.RWMutex
+	rep     models.Reputation
 
 	lastSeeded   map[peer.ID]time.Time
 	muLastSeeded sync.RWMutex
 
-	maxPeers    int
-	maxPerReply int
-	sem         chan struct{}
+	// version is the timestamp of our own record, peers refetch it when it changes
+	version atomic.Int64
+
+	maxPeers      int
+	maxPerReply   int
+	maxPerReplyV2 int
+	sem           chan struct{}
 }
 
 func NewHostPex(c *models.SrvCtx) *HostPex {
-	return &HostPex{
-		host:        c.Host,
-		opts:        c.Opts,
-		ctx:         c.Ctx,
-		dht:         c.Dht,
-		peers:       c.Peers,
-		muPeers:     &c.MuPeers,
-		lastSeeded:  make(map[peer.ID]time.Time),
-		maxPeers:    500,
-		maxPerReply: 100,
-		sem:         make(chan struct{}, 10),
+	p := &HostPex{
+		host:          c.Host,
+		opts:          c.Opts,
+		ctx:           c.Ctx,
+		dht:           c.Dht,
+		hosts:         &c.Hosts,
+		peers:         c.Peers,
+		index:         c.Index,
+		muPeers:       &c.MuPeers,
+		rep:           c.Rep,
+		lastSeeded:    make(map[peer.ID]time.Time),
+		maxPeers:      2000,
+		maxPerReply:   100,
+		maxPerReplyV2: 500,
+		sem:           make(chan struct{}, 10),
 	}
+	p.version.Store(time.Now().UnixNano())
+	return p
 }
 
 func (p *HostPex) Start() error {
 	log.Println("[HOSTPEX] Service started")
 
+	p.host.SetStreamHandler(ProtocolV1, p.handleStreamV1)
+
 	go p.subscribeToEvents()
 	go p.gcLoop()
 	go p.backgroundDiscovery()
@@ -62,6 +89,7 @@ func (p *HostPex) Start() error {
 
 func (p *HostPex) Stop() {
 	log.Println("[HOSTPEX] Service stoping...")
+	p.host.RemoveStreamHandler(ProtocolV1)
 }
 
 func (p *HostPex) Name() string {
@@ -69,14 +97,78 @@ func (p *HostPex) Name() string {
 }
 
 func (p *HostPex) ProtocolID() protocol.ID {
-	return "/tunsgo/hostpex/1.0.0"
+	return ProtocolV2
 }
 
+// HandleStream serves hostpex 2.0.0: the requester sends the keys of the
+// records it already has together with its own record, and gets back only
+// the records it is missing.
 func (p *HostPex) HandleStream(stream network.Stream) {
 	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(30 * time.Second))
 
 	remotePeer := stream.Conn().RemotePeer()
-	peers := p.collectPeersForReply(remotePeer)
+	known, own, err := readRequest(bufio.NewReader(stream))
+	if err != nil {
+		log.Printf("[HOSTPEX] Read request error from %s: %v", remotePeer, err)
+		stream.Reset()
+		return
+	}
+
+	if len(own) > 0 {
+		if info, err := decodeRecord(own); err == nil && info.PeerID == remotePeer.String() {
+			p.addPeer(info, remotePeer)
+		} else {
+			p.rep.Record(remotePeer, reputation.HostpexInvalid)
+		}
+	}
+
+	peers := p.collectPeersForReply(remotePeer, known, p.maxPerReplyV2)
+	records := make([][]byte, 0, len(peers))
+	for _, info := range peers {
+		if pid, err := peer.Decode(info.PeerID); err == nil {
+			records = append(records, encodeRecord(pid, info))
+		}
+	}
+
+	held := p.heldKeys(known)
+	log.Printf("[HOSTPEX] Send peers to %s, count: %v, known: %v, held: %v", remotePeer, len(records), len(known), len(held))
+
+	if err := writeRecords(stream, records, held); err != nil {
+		log.Printf("[HOSTPEX] Encode error to %s: %v", remotePeer, err)
+	}
+}
+
+// heldKeys returns the keys of known we hold a record for, the requester
+// takes them as a sign that the records are still alive.
+func (p *HostPex) heldKeys(known map[uint64]bool) []uint64 {
+	if len(known) == 0 {
+		return nil
+	}
+	var held []uint64
+	if self := p.selfRecord(); self != nil && known[recordKey(p.host.ID(), self.Timestamp)] {
+		held = append(held, recordKey(p.host.ID(), self.Timestamp))
+	}
+
+	p.muPeers.RLock()
+	defer p.muPeers.RUnlock()
+	for pid, info := range p.peers {
+		if len(info.Hosts) == 0 {
+			continue
+		}
+		if k := recordKey(pid, info.Timestamp); known[k] {
+			held = append(held, k)
+		}
+	}
+	return held
+}
+
+// handleStreamV1 serves nodes still speaking hostpex 1.0.0 with full JSON records.
+func (p *HostPex) handleStreamV1(stream network.Stream) {
+	defer stream.Close()
+
+	remotePeer := stream.Conn().RemotePeer()
+	peers := p.collectPeersForReply(remotePeer, nil, p.maxPerReply)
 
 	log.Printf("[HOSTPEX] Send peers to %s, count: %v", stream.Conn().RemotePeer().String(), len(peers))
 
@@ -85,22 +177,40 @@ func (p *HostPex) HandleStream(stream network.Stream) {
 	}
 }
 
-func (p *HostPex) collectPeersForReply(remote peer.ID) []*models.PeerInfo {
+// selfRecord announces the provided hosts of an exit and the .tuns names of
+// our published services.
+func (p *HostPex) selfRecord() *models.PeerInfo {
+	var hosts []string
+	if p.opts.Profile().Exit {
+		hosts = append(hosts, p.hosts.Load().Patterns()...)
+	}
+	hosts = append(hosts, p.opts.PublishedHosts(publish.Owner(p.host.ID()))...)
+	if len(hosts) == 0 {
+		return nil
+	}
+	return &models.PeerInfo{
+		PeerID:    p.host.ID().String(),
+		Hosts:     hosts,
+		Labels:    p.opts.Labels,
+		Timestamp: p.version.Load(),
+		LastSeen:  time.Now(),
+	}
+}
+
+// collectPeersForReply picks up to limit random records for remote, skipping
+// the ones whose keys are in known.
+func (p *HostPex) collectPeersForReply(remote peer.ID, known map[uint64]bool, limit int) []*models.PeerInfo {
 	p.muPeers.RLock()
 	defer p.muPeers.RUnlock()
 
 	tmp := make([]*models.PeerInfo, 0, len(p.peers)+1)
 
-	if len(p.opts.Hosts) > 0 {
-		tmp = append(tmp, &models.PeerInfo{
-			PeerID:   p.host.ID().String(),
-			Hosts:    p.opts.Hosts,
-			LastSeen: time.Now(),
-		})
+	if self := p.selfRecord(); self != nil && !known[recordKey(p.host.ID(), self.Timestamp)] {
+		tmp = append(tmp, self)
 	}
 
 	for pid, info := range p.peers {
-		if pid == remote || len(info.Hosts) == 0 {
+		if pid == remote || len(info.Hosts) == 0 || known[recordKey(pid, info.Timestamp)] {
 			continue
 		}
 		tmp = append(tmp, info)
@@ -114,7 +224,6 @@ func (p *HostPex) collectPeersForReply(remote peer.ID) []*models.PeerInfo {
 		tmp[i], tmp[j] = tmp[j], tmp[i]
 	})
 
-	limit := p.maxPerReply
 	if len(tmp) < limit {
 		limit = len(tmp)
 	}
@@ -122,7 +231,10 @@ func (p *HostPex) collectPeersForReply(remote peer.ID) []*models.PeerInfo {
 }
 
 func (p *HostPex) subscribeToEvents() {
-	sub, err := p.host.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	sub, err := p.host.EventBus().Subscribe([]interface{}{
+		new(event.EvtPeerIdentificationCompleted),
+		new(models.EvtHostsChanged),
+	})
 	if err != nil {
 		log.Printf("[HOSTPEX] EventBus error: %v", err)
 		return
@@ -134,14 +246,40 @@ func (p *HostPex) subscribeToEvents() {
 		case <-p.ctx.Done():
 			return
 		case e := <-sub.Out():
-			evt := e.(event.EvtPeerIdentificationCompleted)
-			p.checkAndRequest(evt.Peer)
+			switch evt := e.(type) {
+			case event.EvtPeerIdentificationCompleted:
+				p.checkAndRequest(evt.Peer)
+			case models.EvtHostsChanged:
+				p.version.Store(time.Now().UnixNano())
+				go p.announce()
+			}
+		}
+	}
+}
+
+// announce pushes our new record to every connected peer speaking
+// hostpex 2.0.0, the exchange carries it along with the request.
+func (p *HostPex) announce() {
+	for _, pid := range p.host.Network().Peers() {
+		protocols, err := p.host.Peerstore().SupportsProtocols(pid, ProtocolV2)
+		if err != nil || len(protocols) == 0 {
+			continue
+		}
+
+		select {
+		case p.sem <- struct{}{}:
+		case <-p.ctx.Done():
+			return
 		}
+		go func() {
+			defer func() { <-p.sem }()
+			p.requestHostsFrom(pid)
+		}()
 	}
 }
 
 func (p *HostPex) checkAndRequest(pid peer.ID) {
-	protocols, err := p.host.Peerstore().SupportsProtocols(pid, p.ProtocolID())
+	protocols, err := p.host.Peerstore().SupportsProtocols(pid, ProtocolV2, ProtocolV1)
 	if err != nil || len(protocols) == 0 {
 		return
 	}
@@ -170,14 +308,21 @@ func (p *HostPex) requestHostsFrom(id peer.ID) {
 	ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
 	defer cancel()
 
-	stream, err := p.host.NewStream(ctx, id, p.ProtocolID())
+	stream, err := p.host.NewStream(ctx, id, ProtocolV2, ProtocolV1)
 	if err != nil {
 		return
 	}
 	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(30 * time.Second))
 
 	var discovered []*models.PeerInfo
-	if err := json.NewDecoder(stream).Decode(&discovered); err != nil {
+	if stream.Protocol() == ProtocolV2 {
+		discovered, err = p.exchangeV2(stream)
+	} else {
+		err = json.NewDecoder(stream).Decode(&discovered)
+	}
+	if err != nil {
+		p.rep.Record(id, reputation.HostpexInvalid)
 		return
 	}
 
@@ -185,45 +330,146 @@ func (p *HostPex) requestHostsFrom(id peer.ID) {
 	p.lastSeeded[id] = time.Now()
 	p.muLastSeeded.Unlock()
 
+	valid := 0
 	for _, info := range discovered {
-		p.addPeer(info)
+		if p.addPeer(info, id) {
+			valid++
+		}
+	}
+	if valid < len(discovered) {
+		p.rep.Record(id, reputation.HostpexInvalid)
+	} else if valid > 0 {
+		p.rep.Record(id, reputation.HostpexValid)
 	}
 }
 
-func (p *HostPex) addPeer(info *models.PeerInfo) {
+func (p *HostPex) exchangeV2(stream network.Stream) ([]*models.PeerInfo, error) {
+	p.muPeers.RLock()
+	keys := make([]uint64, 0, len(p.peers))
+	byKey := make(map[uint64]peer.ID, len(p.peers))
+	for pid, info := range p.peers {
+		k := recordKey(pid, info.Timestamp)
+		keys = append(keys, k)
+		byKey[k] = pid
+	}
+	p.muPeers.RUnlock()
+
+	var own []byte
+	if self := p.selfRecord(); self != nil {
+		own = encodeRecord(p.host.ID(), self)
+	}
+
+	if err := writeRequest(stream, keys, own); err != nil {
+		return nil, err
+	}
+	stream.CloseWrite()
+
+	reader := bufio.NewReader(stream)
+	records, err := readRecords(reader, p.maxPerReplyV2)
+	if err != nil {
+		return nil, err
+	}
+	// records we already have are not resent, the held keys keep them alive
+	if held, err := readKeys(reader); err == nil {
+		p.touch(byKey, held)
+	}
+
+	discovered := make([]*models.PeerInfo, 0, len(records))
+	for _, rec := range records {
+		// a broken record still goes to addPeer so it is counted as invalid
+		info, _ := decodeRecord(rec)
+		discovered = append(discovered, info)
+	}
+	return discovered, nil
+}
+
+// touch refreshes LastSeen of the records behind held keys, unless they
+// were replaced meanwhile.
+func (p *HostPex) touch(byKey map[uint64]peer.ID, held []uint64) {
+	now := time.Now()
+	p.muPeers.Lock()
+	defer p.muPeers.Unlock()
+	for _, k := range held {
+		pid, ok := byKey[k]
+		if !ok {
+			continue
+		}
+		if info, ok := p.peers[pid]; ok && recordKey(pid, info.Timestamp) == k {
+			info.LastSeen = now
+		}
+	}
+}
+
+// maxClockSkew is how far in the future record timestamps may be, records
+// are unsigned and a relayed one far ahead would shadow every later version.
+const maxClockSkew = 10 * time.Minute
+
+// addPeer stores a record received from the from peer and reports whether it
+// was well formed. Records of blocked peers are dropped but still count as
+// valid. A peer's own record always wins, relayed ones only replace older
+// records and never the own record of a connected peer, so a forged record
+// lasts until the peer is asked directly.
+func (p *HostPex) addPeer(info *models.PeerInfo, from peer.ID) bool {
+	if info == nil {
+		return false
+	}
 	pid, err := peer.Decode(info.PeerID)
-	if err != nil || pid == p.host.ID() {
-		return
+	if err != nil || utils.CheckRemotePatterns(info.Hosts) != nil || models.CheckLabels(info.Labels) != nil {
+		return false
+	}
+	if info.Timestamp > time.Now().Add(maxClockSkew).UnixNano() {
+		return false
+	}
+	if pid == p.host.ID() || !utils.AllowedPeer(p.opts.Access.OnlyUse, p.opts.Access.DenyUse, pid) {
+		return true
 	}
+	info.FirstHand = pid == from
+	connected := p.host.Network().Connectedness(pid) == network.Connected
 
 	p.muPeers.Lock()
-	if len(p.peers) >= p.maxPeers {
-		p.remOldest(10)
+	defer p.muPeers.Unlock()
+
+	old, ok := p.peers[pid]
+	if ok && !info.FirstHand && ((old.FirstHand && connected) || old.Timestamp >= info.Timestamp) {
+		// keep the newer or first-hand record we already have
+		old.LastSeen = time.Now()
+		return true
+	}
+	if !ok && len(p.peers) >= p.maxPeers {
+		p.remWorst(10)
 	}
 	info.LastSeen = time.Now()
+	if ok {
+		info.LastResp = old.LastResp
+	}
 	p.peers[pid] = info
-	p.muPeers.Unlock()
+	p.index.Set(pid, info.Hosts)
+	return true
 }
 
-func (p *HostPex) remOldest(count int) {
-	for i := 0; i < count; i++ {
-		var oldestID peer.ID
-		var oldestTime time.Time
-		found := false
-
-		for pid, info := range p.peers {
-			if !found || info.LastSeen.Before(oldestTime) {
-				oldestTime = info.LastSeen
-				oldestID = pid
-				found = true
-			}
-		}
+// remWorst drops the peers with the lowest reputation, the oldest first
+// among equal scores.
+func (p *HostPex) remWorst(count int) {
+	type candidate struct {
+		id    peer.ID
+		score float64
+		seen  time.Time
+	}
+	list := make([]candidate, 0, len(p.peers))
+	for pid, info := range p.peers {
+		list = append(list, candidate{pid, p.rep.Score(pid), info.LastSeen})
+	}
 
-		if found {
-			delete(p.peers, oldestID)
-		} else {
-			break
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].score != list[j].score {
+			return list[i].score < list[j].score
 		}
+		return list[i].seen.Before(list[j].seen)
+	})
+
+	for i := 0; i < count && i < len(list); i++ {
+		delete(p.peers, list[i].id)
+		p.index.Remove(list[i].id)
 	}
 }
 
@@ -264,6 +510,7 @@ func (p *HostPex) cleanup() {
 	for pid, info := range p.peers {
 		if now.Sub(info.LastSeen) > 30*time.Minute {
 			delete(p.peers, pid)
+			p.index.Remove(pid)
 		}
 	}
 	p.muPeers.Unlock()
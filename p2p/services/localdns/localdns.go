@@ -0,0 +1,214 @@
+package localdns
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/miekg/dns"
+)
+
+// LocalDns is a DNS server for devices that can't be configured with a
+// proxy: hosts served by the mesh resolve to the gateway, everything else
+// is forwarded upstream.
+type LocalDns struct {
+	opts *opts.Options
+	ctx  context.Context
+
+	hosts    *atomic.Pointer[utils.HostMatcher]
+	dnsHosts *utils.HostMatcher
+
+	peers   map[peer.ID]*models.PeerInfo
+	index   *models.HostIndex
+	muPeers *sync.RWMutex
+
+	upstream []string
+	servers  []*dns.Server
+}
+
+func NewLocalDns(c *models.SrvCtx) *LocalDns {
+	return &LocalDns{
+		opts:     c.Opts,
+		ctx:      c.Ctx,
+		hosts:    &c.Hosts,
+		dnsHosts: utils.CompileHosts(c.Opts.DNS.Hosts),
+		peers:    c.Peers,
+		index:    c.Index,
+		muPeers:  &c.MuPeers,
+	}
+}
+
+func (l *LocalDns) Start() error {
+	l.upstream = l.opts.DNS.Upstream
+	if len(l.upstream) == 0 {
+		cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return fmt.Errorf("no dns upstream configured: %v", err)
+		}
+		for _, srv := range cfg.Servers {
+			l.upstream = append(l.upstream, net.JoinHostPort(srv, cfg.Port))
+		}
+	}
+
+	for _, netw := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: l.opts.DNS.Listen, Net: netw, Handler: l}
+		started := make(chan error, 1)
+		srv.NotifyStartedFunc = func() { started <- nil }
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				started <- err
+			}
+		}()
+		if err := <-started; err != nil {
+			l.Stop()
+			return err
+		}
+		l.servers = append(l.servers, srv)
+	}
+
+	log.Println("[LOCALDNS] Service started on", l.opts.DNS.Listen, "upstream:", l.upstream)
+	return nil
+}
+
+func (l *LocalDns) Stop() {
+	log.Println("[LOCALDNS] Service stoping...")
+	for _, srv := range l.servers {
+		srv.Shutdown()
+	}
+	l.servers = nil
+}
+
+func (l *LocalDns) Name() string {
+	return "LocalDNS"
+}
+
+func (l *LocalDns) ProtocolID() protocol.ID {
+	return ""
+}
+
+func (l *LocalDns) HandleStream(stream network.Stream) {
+	stream.Close()
+}
+
+func (l *LocalDns) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) == 1 && l.steered(req.Question[0].Name) {
+		w.WriteMsg(l.gatewayAnswer(w, req))
+		return
+	}
+
+	resp, err := l.forward(req, w.RemoteAddr().Network())
+	if err != nil {
+		log.Printf("[LOCALDNS] Forward %v error: %v", req.Question, err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	w.WriteMsg(resp)
+}
+
+// steered reports whether name is served through the mesh: it matches our
+// own provided hosts, a host of a known peer or dns.hosts. Bare "*" patterns
+// are skipped, they would steer every name to the gateway.
+func (l *LocalDns) steered(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+
+	if l.dnsHosts.MatchSpecific(name) || l.hosts.Load().MatchSpecific(name) {
+		return true
+	}
+
+	l.muPeers.RLock()
+	defer l.muPeers.RUnlock()
+	for _, id := range l.index.Lookup(name) {
+		if info, ok := l.peers[id]; ok && info.Matcher().MatchSpecific(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayAnswer answers A and AAAA with the gateway addresses, other types
+// get an empty answer so clients don't bypass the gateway.
+func (l *LocalDns) gatewayAnswer(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(l.opts.DNS.TTL)}
+	for _, ip := range l.gatewayIPs(w) {
+		switch {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return resp
+}
+
+// gatewayIPs returns dns.address, or the local address the client reaches
+// us on when it is not configured.
+func (l *LocalDns) gatewayIPs(w dns.ResponseWriter) []net.IP {
+	var ips []net.IP
+	for _, s := range l.opts.DNS.Address {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) > 0 {
+		return ips
+	}
+
+	if ip := addrIP(w.LocalAddr()); ip != nil && !ip.IsUnspecified() {
+		return []net.IP{ip}
+	}
+
+	// the route towards the client tells which of our addresses it sees
+	remote := addrIP(w.RemoteAddr())
+	if remote == nil {
+		return nil
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(remote.String(), "53"))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if ip := addrIP(conn.LocalAddr()); ip != nil {
+		return []net.IP{ip}
+	}
+	return nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (l *LocalDns) forward(req *dns.Msg, netw string) (*dns.Msg, error) {
+	client := &dns.Client{Net: netw, Timeout: 5 * time.Second}
+	var lastErr error
+	for _, srv := range l.upstream {
+		resp, _, err := client.Exchange(req, srv)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
@@ -39,6 +39,12 @@ func (m *Manager) AddService(srv P2PService) {
 	}
 }
 
+// AddClientService adds a service without its stream handler, so the node
+// uses the protocol of other peers but does not serve it.
+func (m *Manager) AddClientService(srv P2PService) {
+	m.Services = append(m.Services, srv)
+}
+
 func (m *Manager) Start() error {
 	for _, srv := range m.Services {
 		err := srv.Start()
@@ -0,0 +1,86 @@
+package mdns
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mdnsdisc "github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+const ServiceName = "_tunsgo._udp"
+
+type Mdns struct {
+	host host.Host
+	opts *opts.Options
+	ctx  context.Context
+	rep  models.Reputation
+
+	srv mdnsdisc.Service
+}
+
+func NewMdns(c *models.SrvCtx) *Mdns {
+	return &Mdns{
+		host: c.Host,
+		opts: c.Opts,
+		ctx:  c.Ctx,
+		rep:  c.Rep,
+	}
+}
+
+func (m *Mdns) Start() error {
+	m.srv = mdnsdisc.NewMdnsService(m.host, ServiceName, m)
+	if err := m.srv.Start(); err != nil {
+		return err
+	}
+	log.Println("[MDNS] Service started")
+	return nil
+}
+
+func (m *Mdns) Stop() {
+	log.Println("[MDNS] Service stoping...")
+	if m.srv != nil {
+		m.srv.Close()
+	}
+}
+
+func (m *Mdns) Name() string {
+	return "Mdns"
+}
+
+func (m *Mdns) ProtocolID() protocol.ID {
+	return ""
+}
+
+func (m *Mdns) HandleStream(stream network.Stream) {
+	stream.Close()
+}
+
+// HandlePeerFound is called by the mdns resolver for every node announcing
+// itself on the local network. Hostpex and pex kick in on their own once the
+// identify exchange with the new peer is completed.
+func (m *Mdns) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == m.host.ID() || m.host.Network().Connectedness(pi.ID) == network.Connected {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(m.ctx, 15*time.Second)
+		defer cancel()
+
+		if err := m.host.Connect(ctx, pi); err != nil {
+			log.Printf("[MDNS] Error connect to %s: %v", pi.ID, err)
+			return
+		}
+		log.Println("[MDNS] Connected to LAN peer", pi.ID)
+
+		m.rep.Record(pi.ID, reputation.Connected)
+	}()
+}
@@ -0,0 +1,385 @@
+package meshdns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/miekg/dns"
+)
+
+const ProtocolID protocol.ID = "/tunsgo/dns/1.0.0"
+
+// MeshDns resolves names through exits, so consumers get the answers the
+// exit sees. A stream carries one query and its answer as DNS messages with
+// a uint16 length prefix, like DNS over TCP.
+type MeshDns struct {
+	host host.Host
+	opts *opts.Options
+	ctx  context.Context
+	rep  models.Reputation
+
+	hosts  *atomic.Pointer[utils.HostMatcher]
+	routes *models.RouteTable
+
+	// candidates returns the exits allowing a host and having the labels,
+	// best first
+	candidates func(string, *models.LabelSelector) []peer.ID
+
+	cache   map[cacheKey]*cacheEntry
+	muCache sync.Mutex
+
+	upstream *dns.ClientConfig
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+func NewMeshDns(c *models.SrvCtx, candidates func(string, *models.LabelSelector) []peer.ID) *MeshDns {
+	return &MeshDns{
+		host:       c.Host,
+		opts:       c.Opts,
+		ctx:        c.Ctx,
+		rep:        c.Rep,
+		hosts:      &c.Hosts,
+		routes:     c.Routes,
+		candidates: candidates,
+		cache:      make(map[cacheKey]*cacheEntry),
+	}
+}
+
+func (m *MeshDns) Start() error {
+	log.Println("[DNS] Service started")
+
+	// without resolv.conf exits fall back to the system resolver
+	if cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil && len(cfg.Servers) > 0 {
+		m.upstream = cfg
+	}
+
+	go m.gcLoop()
+	return nil
+}
+
+func (m *MeshDns) Stop() {
+	log.Println("[DNS] Service stoping...")
+}
+
+func (m *MeshDns) Name() string {
+	return "MeshDNS"
+}
+
+func (m *MeshDns) ProtocolID() protocol.ID {
+	return ProtocolID
+}
+
+func (m *MeshDns) HandleStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(15 * time.Second))
+
+	req, err := readMsg(stream)
+	if err != nil {
+		stream.Reset()
+		return
+	}
+
+	resp := m.answer(req, stream.Conn().RemotePeer())
+	if err = writeMsg(stream, resp); err != nil {
+		log.Printf("[DNS] Write answer error to %s: %v", stream.Conn().RemotePeer(), err)
+	}
+}
+
+// answer resolves req for remote, only A, AAAA and CNAME questions about
+// our provided hosts are answered.
+func (m *MeshDns) answer(req *dns.Msg, remote peer.ID) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	if !utils.AllowedPeer(m.opts.Access.OnlyServe, m.opts.Access.DenyServe, remote) || len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+
+	q := req.Question[0]
+	name := strings.TrimSuffix(q.Name, ".")
+	if !supportedType(q.Qtype) || !m.hosts.Load().Match(name) {
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+
+	answers, rcode, err := m.resolveLocal(q)
+	if err != nil {
+		log.Printf("[DNS] Resolve %s error: %v", name, err)
+		resp.Rcode = dns.RcodeServerFailure
+		return resp
+	}
+	resp.Rcode = rcode
+	for _, rr := range answers {
+		if supportedType(rr.Header().Rrtype) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return resp
+}
+
+func (m *MeshDns) resolveLocal(q dns.Question) ([]dns.RR, int, error) {
+	if m.upstream == nil {
+		return lookupSystem(m.ctx, q)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.RecursionDesired = true
+
+	client := &dns.Client{Timeout: 5 * time.Second}
+	var lastErr error
+	for _, srv := range m.upstream.Servers {
+		resp, _, err := client.Exchange(req, net.JoinHostPort(srv, m.upstream.Port))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode == dns.RcodeNameError {
+			// names from the hosts file are what our own dials see
+			return lookupSystem(m.ctx, q)
+		}
+		return resp.Answer, resp.Rcode, nil
+	}
+	return nil, 0, lastErr
+}
+
+// lookupSystem answers through the system resolver, which hides the TTL.
+func lookupSystem(ctx context.Context, q dns.Question) ([]dns.RR, int, error) {
+	const ttl = 60
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: t, Class: dns.ClassINET, Ttl: ttl}
+	}
+	// the hosts file is only consulted for names without the root dot
+	name := strings.TrimSuffix(q.Name, ".")
+
+	if q.Qtype == dns.TypeCNAME {
+		cname, err := net.DefaultResolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, dns.RcodeNameError, nil
+		}
+		if cname == q.Name || cname == name {
+			return nil, dns.RcodeSuccess, nil
+		}
+		return []dns.RR{&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: cname}}, dns.RcodeSuccess, nil
+	}
+
+	ipNet := "ip4"
+	if q.Qtype == dns.TypeAAAA {
+		ipNet = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, ipNet, name)
+	if err != nil {
+		return nil, dns.RcodeNameError, nil
+	}
+
+	var answers []dns.RR
+	for _, ip := range ips {
+		if q.Qtype == dns.TypeA {
+			answers = append(answers, &dns.A{Hdr: hdr(dns.TypeA), A: ip})
+		} else {
+			answers = append(answers, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	return answers, dns.RcodeSuccess, nil
+}
+
+// Exchange resolves the single question of req through an exit providing
+// its name, answers are cached by their TTL.
+func (m *MeshDns) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 || !supportedType(req.Question[0].Qtype) {
+		return nil, fmt.Errorf("only single A, AAAA or CNAME questions are supported")
+	}
+	q := req.Question[0]
+	key := cacheKey{strings.ToLower(dns.Fqdn(q.Name)), q.Qtype}
+
+	if resp := m.cached(key); resp != nil {
+		resp.Id = req.Id
+		return resp, nil
+	}
+
+	name := strings.TrimSuffix(key.name, ".")
+	// answers depend on the region of the exit, so its labels count too
+	exits := m.candidates(name, m.routes.Lookup(name).Labels)
+	if len(exits) == 0 {
+		return nil, fmt.Errorf("no proxy nodes available for %s", name)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(key.name, q.Qtype)
+
+	for _, id := range exits {
+		if !m.supports(id) {
+			continue
+		}
+		resp, err := m.exchangeWith(ctx, id, query)
+		if err != nil {
+			log.Printf("[DNS] Query %s via %s failed: %v", name, id, err)
+			m.rep.Record(id, reputation.ProxyFailure)
+			continue
+		}
+		if resp.Rcode == dns.RcodeRefused {
+			continue
+		}
+		m.rep.Record(id, reputation.ProxySuccess)
+		m.store(key, resp)
+		resp.Id = req.Id
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no nodes available for %s", name)
+}
+
+func (m *MeshDns) exchangeWith(ctx context.Context, id peer.ID, req *dns.Msg) (*dns.Msg, error) {
+	stream, err := m.host.NewStream(ctx, id, ProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	stream.SetDeadline(deadline)
+
+	if err = writeMsg(stream, req); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	stream.CloseWrite()
+
+	resp, err := readMsg(stream)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != req.Id {
+		return nil, fmt.Errorf("answer id mismatch")
+	}
+	return resp, nil
+}
+
+// supports reports whether id may speak the DNS protocol, peers that were
+// never identified are tried anyway.
+func (m *MeshDns) supports(id peer.ID) bool {
+	protos, err := m.host.Peerstore().GetProtocols(id)
+	if err != nil || len(protos) == 0 {
+		return true
+	}
+	for _, p := range protos {
+		if p == ProtocolID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MeshDns) cached(key cacheKey) *dns.Msg {
+	m.muCache.Lock()
+	defer m.muCache.Unlock()
+
+	e, ok := m.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	return e.msg.Copy()
+}
+
+func (m *MeshDns) store(key cacheKey, resp *dns.Msg) {
+	ttl := uint32(60) // negative answers
+	for i, rr := range resp.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	if ttl > 3600 {
+		ttl = 3600
+	}
+
+	m.muCache.Lock()
+	m.cache[key] = &cacheEntry{msg: resp.Copy(), expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	m.muCache.Unlock()
+}
+
+func (m *MeshDns) gcLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			m.muCache.Lock()
+			for k, e := range m.cache {
+				if now.After(e.expires) {
+					delete(m.cache, k)
+				}
+			}
+			m.muCache.Unlock()
+		}
+	}
+}
+
+func supportedType(t uint16) bool {
+	return t == dns.TypeA || t == dns.TypeAAAA || t == dns.TypeCNAME
+}
+
+func readMsg(r io.Reader) (*dns.Msg, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeMsg(w io.Writer, msg *dns.Msg) error {
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if len(buf) > 65535 {
+		return fmt.Errorf("dns message too large: %d", len(buf))
+	}
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	copy(frame[2:], buf)
+	_, err = w.Write(frame)
+	return err
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"log"
 	"math/rand"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/YouROK/tunsgo/opts"
 	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/YouROK/tunsgo/p2p/utils"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -21,6 +24,10 @@ type Pex struct {
 	host host.Host
 	opts *opts.Options
 	ctx  context.Context
+	rep  models.Reputation
+
+	// filters keep unreachable addresses out of the replies
+	filters []*net.IPNet
 
 	lastSeeded   map[peer.ID]time.Time
 	muLastSeeded sync.RWMutex
@@ -28,10 +35,15 @@ type Pex struct {
 }
 
 func NewPex(c *models.SrvCtx) *Pex {
+	// loopback addresses are never reachable for the remote side
+	loopback, _ := utils.ParseCIDRs([]string{"loopback"})
+
 	return &Pex{
 		host:       c.Host,
 		opts:       c.Opts,
 		ctx:        c.Ctx,
+		rep:        c.Rep,
+		filters:    append(loopback, c.AddrFilters...),
 		lastSeeded: make(map[peer.ID]time.Time),
 		sem:        make(chan struct{}, 5),
 	}
@@ -85,7 +97,7 @@ func (p *Pex) collectAddrInfos(exclude peer.ID) []peer.AddrInfo {
 
 	for _, pid := range p.host.Network().Peers() {
 		if !added[pid] && p.isTunsGoPeer(pid) {
-			info := p.host.Peerstore().PeerInfo(pid)
+			info := p.addrInfo(pid)
 			if len(info.Addrs) > 0 {
 				res = append(res, info)
 				added[pid] = true
@@ -99,7 +111,7 @@ func (p *Pex) collectAddrInfos(exclude peer.ID) []peer.AddrInfo {
 	if len(res) < 30 {
 		for _, pid := range p.host.Peerstore().Peers() {
 			if !added[pid] && p.isTunsGoPeer(pid) {
-				info := p.host.Peerstore().PeerInfo(pid)
+				info := p.addrInfo(pid)
 				if len(info.Addrs) > 0 {
 					res = append(res, info)
 					added[pid] = true
@@ -113,6 +125,12 @@ func (p *Pex) collectAddrInfos(exclude peer.ID) []peer.AddrInfo {
 	return res
 }
 
+func (p *Pex) addrInfo(pid peer.ID) peer.AddrInfo {
+	info := p.host.Peerstore().PeerInfo(pid)
+	info.Addrs = utils.FilterAddrs(info.Addrs, p.filters)
+	return info
+}
+
 func (p *Pex) subscribeToEvents() {
 	sub, _ := p.host.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
 	defer sub.Close()
@@ -174,12 +192,19 @@ func (p *Pex) requestPeersFrom(id peer.ID) {
 	p.lastSeeded[id] = time.Now()
 	p.muLastSeeded.Unlock()
 
+	fresh := 0
 	for _, info := range discovered {
 		if info.ID == p.host.ID() {
 			continue
 		}
+		if len(p.host.Peerstore().Addrs(info.ID)) == 0 {
+			fresh++
+		}
 		p.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
 	}
+	if fresh > 0 {
+		p.rep.Record(id, reputation.PexUseful)
+	}
 }
 
 func (p *Pex) isTunsGoPeer(id peer.ID) bool {
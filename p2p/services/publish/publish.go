@@ -0,0 +1,149 @@
+package publish
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multibase"
+)
+
+const ProtocolID protocol.ID = "/tunsgo/publish/1.0.0"
+
+// Publish serves local services published under <name>.<owner>.tuns to the
+// allowlisted peers of the mesh, owner being our peer ID.
+type Publish struct {
+	host host.Host
+	opts *opts.Options
+	ctx  context.Context
+
+	services map[string]*service
+}
+
+type service struct {
+	addr  string
+	allow map[string]bool
+}
+
+func NewPublish(c *models.SrvCtx) *Publish {
+	return &Publish{
+		host:     c.Host,
+		opts:     c.Opts,
+		ctx:      c.Ctx,
+		services: make(map[string]*service),
+	}
+}
+
+func (p *Publish) Start() error {
+	owner := Owner(p.host.ID())
+	for _, pub := range p.opts.Publish {
+		if pub.Name == "" && pub.Target == "" {
+			continue
+		}
+		u, err := url.Parse(pub.Target)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid publish target %q", pub.Target)
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			addr = net.JoinHostPort(u.Hostname(), port)
+		}
+
+		srv := &service{addr: addr, allow: make(map[string]bool)}
+		for _, id := range pub.Allow {
+			srv.allow[id] = true
+		}
+		p.services[strings.ToLower(pub.Name)+"."+owner+opts.TunsSuffix] = srv
+	}
+
+	log.Println("[PUBLISH] Service started, published:", p.opts.PublishedHosts(owner))
+	return nil
+}
+
+func (p *Publish) Stop() {
+	log.Println("[PUBLISH] Service stoping...")
+}
+
+func (p *Publish) Name() string {
+	return "Publish"
+}
+
+func (p *Publish) ProtocolID() protocol.ID {
+	return ProtocolID
+}
+
+func (p *Publish) HandleStream(stream network.Stream) {
+	defer stream.Close()
+
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	name := strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+
+	srv, ok := p.services[strings.ToLower(name)]
+	if !ok {
+		fmt.Fprintf(stream, "HTTP/1.1 404 Not Found\r\n\r\nService Not Published")
+		return
+	}
+
+	remote := stream.Conn().RemotePeer()
+	if !srv.allowed(remote) {
+		log.Printf("[PUBLISH] Peer %s is not allowed to %s", remote, name)
+		fmt.Fprintf(stream, "HTTP/1.1 403 Forbidden\r\n\r\nPeer Not Allowed")
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", srv.addr, 15*time.Second)
+	if err != nil {
+		fmt.Fprintf(stream, "HTTP/1.1 502 Bad Gateway\r\n\r\nFailed to connect to service: %v", err)
+		return
+	}
+
+	defer conn.Close()
+
+	utils.Splice(utils.WithReader(stream, reader), conn)
+}
+
+// Owner is the label binding published names to id: the peer ID as a base36
+// CID, which survives lowercasing and fits in a DNS label.
+func Owner(id peer.ID) string {
+	s, _ := peer.ToCid(id).StringOfBase(multibase.Base36)
+	return s
+}
+
+// Publisher returns the peer owning a <name>.<owner>.tuns host.
+func Publisher(host string) (peer.ID, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), opts.TunsSuffix)
+	i := strings.LastIndexByte(host, '.')
+	if i <= 0 {
+		return "", false
+	}
+	id, err := peer.Decode(host[i+1:])
+	return id, err == nil
+}
+
+func (s *service) allowed(id peer.ID) bool {
+	return s.allow["*"] || s.allow[id.String()]
+}
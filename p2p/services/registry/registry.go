@@ -0,0 +1,268 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const stateFile = "peers.json"
+
+// record is a snapshot of a known tuns peer as it is kept on disk.
+type record struct {
+	PeerID    string            `json:"peer_id"`
+	Addrs     []string          `json:"addrs,omitempty"`
+	Hosts     []string          `json:"hosts,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	Score     float64           `json:"score"`
+	LastResp  time.Time         `json:"last_resp"`
+	LastSeen  time.Time         `json:"last_seen"`
+}
+
+type Registry struct {
+	host host.Host
+	opts *opts.Options
+	ctx  context.Context
+
+	peers   map[peer.ID]*models.PeerInfo
+	index   *models.HostIndex
+	muPeers *sync.RWMutex
+	rep     models.Reputation
+
+	dir      string
+	maxDials int
+	muSave   sync.Mutex
+}
+
+func NewRegistry(c *models.SrvCtx) *Registry {
+	dir := c.Opts.State.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(os.Args[0]), dir)
+	}
+	return &Registry{
+		host:     c.Host,
+		opts:     c.Opts,
+		ctx:      c.Ctx,
+		peers:    c.Peers,
+		index:    c.Index,
+		muPeers:  &c.MuPeers,
+		rep:      c.Rep,
+		dir:      dir,
+		maxDials: 10,
+	}
+}
+
+func (r *Registry) Start() error {
+	if !r.opts.State.ReadOnly {
+		if err := os.MkdirAll(r.dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	records := r.load()
+	log.Printf("[REGISTRY] Service started, restored %d peers from %s", len(records), r.dir)
+
+	go r.dialBest(records)
+	if !r.opts.State.ReadOnly {
+		go r.saveLoop()
+	}
+	return nil
+}
+
+func (r *Registry) Stop() {
+	log.Println("[REGISTRY] Service stoping...")
+	if r.opts.State.ReadOnly {
+		return
+	}
+	if err := r.save(); err != nil {
+		log.Printf("[REGISTRY] Error save state: %v", err)
+	}
+}
+
+func (r *Registry) Name() string {
+	return "Registry"
+}
+
+func (r *Registry) ProtocolID() protocol.ID {
+	return ""
+}
+
+func (r *Registry) HandleStream(stream network.Stream) {
+	stream.Close()
+}
+
+func (r *Registry) saveLoop() {
+	ticker := time.NewTicker(time.Duration(r.opts.State.SaveInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.save(); err != nil {
+				log.Printf("[REGISTRY] Error save state: %v", err)
+			}
+		}
+	}
+}
+
+func (r *Registry) load() []*record {
+	buf, err := os.ReadFile(filepath.Join(r.dir, stateFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[REGISTRY] Error read state: %v", err)
+		}
+		return nil
+	}
+
+	var records []*record
+	if err = json.Unmarshal(buf, &records); err != nil {
+		log.Printf("[REGISTRY] Error parse state: %v", err)
+		return nil
+	}
+
+	// 0 or less keeps records of any age, their addresses get the usual TTL
+	maxAge := time.Duration(r.opts.State.MaxAgeHours) * time.Hour
+	addrTTL := maxAge
+	if maxAge <= 0 {
+		addrTTL = peerstore.AddressTTL
+	}
+	res := make([]*record, 0, len(records))
+
+	r.muPeers.Lock()
+	for _, rec := range records {
+		pid, err := peer.Decode(rec.PeerID)
+		if err != nil || pid == r.host.ID() || (maxAge > 0 && time.Since(rec.LastSeen) > maxAge) {
+			continue
+		}
+		if !utils.AllowedPeer(r.opts.Access.OnlyUse, r.opts.Access.DenyUse, pid) {
+			continue
+		}
+
+		for _, a := range rec.Addrs {
+			if addr, err := multiaddr.NewMultiaddr(a); err == nil {
+				r.host.Peerstore().AddAddr(pid, addr, addrTTL)
+			}
+		}
+
+		r.rep.Set(pid, rec.Score)
+		// max_age_hours was checked above, from here on the record gets the
+		// usual hostpex lifetime to be confirmed by the mesh again
+		if _, ok := r.peers[pid]; !ok && len(rec.Hosts) > 0 && utils.CheckRemotePatterns(rec.Hosts) == nil && models.CheckLabels(rec.Labels) == nil {
+			r.peers[pid] = &models.PeerInfo{
+				PeerID:    rec.PeerID,
+				Hosts:     rec.Hosts,
+				Labels:    rec.Labels,
+				Timestamp: rec.Timestamp,
+				LastResp:  rec.LastResp,
+				LastSeen:  time.Now(),
+			}
+			r.index.Set(pid, rec.Hosts)
+		}
+		res = append(res, rec)
+	}
+	r.muPeers.Unlock()
+
+	return res
+}
+
+// dialBest connects directly to the healthiest exits of the previous run,
+// so they are usable before the DHT and hostpex catch up.
+func (r *Registry) dialBest(records []*record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Score != records[j].Score {
+			return records[i].Score > records[j].Score
+		}
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+
+	var wg sync.WaitGroup
+	for i, rec := range records {
+		if i >= r.maxDials {
+			break
+		}
+		pid, err := peer.Decode(rec.PeerID)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.ctx, 15*time.Second)
+			defer cancel()
+
+			if err := r.host.Connect(ctx, peer.AddrInfo{ID: pid}); err != nil {
+				return
+			}
+			log.Println("[REGISTRY] Reconnected to", pid)
+
+			r.rep.Record(pid, reputation.Connected)
+			r.muPeers.Lock()
+			if info, ok := r.peers[pid]; ok {
+				info.LastSeen = time.Now()
+			}
+			r.muPeers.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+func (r *Registry) snapshot() []*record {
+	r.muPeers.RLock()
+	defer r.muPeers.RUnlock()
+
+	records := make([]*record, 0, len(r.peers))
+	for pid, info := range r.peers {
+		rec := &record{
+			PeerID:    pid.String(),
+			Hosts:     info.Hosts,
+			Labels:    info.Labels,
+			Timestamp: info.Timestamp,
+			LastResp:  info.LastResp,
+			LastSeen:  info.LastSeen,
+			Score:     r.rep.Score(pid),
+		}
+		for _, a := range r.host.Peerstore().Addrs(pid) {
+			rec.Addrs = append(rec.Addrs, a.String())
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func (r *Registry) save() error {
+	r.muSave.Lock()
+	defer r.muSave.Unlock()
+
+	buf, err := json.MarshalIndent(r.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(r.dir, stateFile)
+	tmp := filename + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
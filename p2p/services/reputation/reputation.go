@@ -0,0 +1,205 @@
+package reputation
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Tag is the connection manager tag carrying the peer score.
+	Tag = "tuns-node"
+
+	protectTag   = "tuns-reputation"
+	protectScore = 50
+	maxScore     = 100
+	halfLife     = 30 * time.Minute
+)
+
+type Event = models.RepEvent
+
+const (
+	Connected      = models.RepConnected
+	ProxySuccess   = models.RepProxySuccess
+	ProxyFailure   = models.RepProxyFailure
+	HostpexValid   = models.RepHostpexValid
+	HostpexInvalid = models.RepHostpexInvalid
+	PexUseful      = models.RepPexUseful
+)
+
+var weights = map[Event]float64{
+	Connected:      2,
+	ProxySuccess:   10,
+	ProxyFailure:   -15,
+	HostpexValid:   3,
+	HostpexInvalid: -20,
+	PexUseful:      1,
+}
+
+// uptimeWeight is credited to connected peers every minute
+const uptimeWeight = 0.5
+
+type entry struct {
+	score   float64
+	updated time.Time
+}
+
+// decay brings the score closer to zero according to the time passed since
+// the last update, so old merits and faults are forgotten.
+func (e *entry) decay(now time.Time) {
+	dt := now.Sub(e.updated)
+	if dt > 0 {
+		e.score *= math.Pow(0.5, float64(dt)/float64(halfLife))
+	}
+	e.updated = now
+}
+
+// Reputation keeps a decaying score for every tuns peer. The score drives
+// the connection manager tags, exit ordering and peer pruning.
+type Reputation struct {
+	host host.Host
+	ctx  context.Context
+
+	peers map[peer.ID]*entry
+	mu    sync.Mutex
+}
+
+func NewReputation(h host.Host, ctx context.Context) *Reputation {
+	return &Reputation{
+		host:  h,
+		ctx:   ctx,
+		peers: make(map[peer.ID]*entry),
+	}
+}
+
+func (r *Reputation) Start() error {
+	log.Println("[REPUTATION] Service started")
+	go r.updateLoop()
+	return nil
+}
+
+func (r *Reputation) Stop() {
+	log.Println("[REPUTATION] Service stoping...")
+}
+
+func (r *Reputation) Name() string {
+	return "Reputation"
+}
+
+func (r *Reputation) ProtocolID() protocol.ID {
+	return ""
+}
+
+func (r *Reputation) HandleStream(stream network.Stream) {
+	stream.Close()
+}
+
+// Record applies the weight of ev to the peer score and refreshes its tag.
+func (r *Reputation) Record(id peer.ID, ev Event) {
+	r.add(id, weights[ev])
+	r.updateTag(id)
+}
+
+// Set overrides the stored score, used to restore scores of a previous run.
+// The tag only sticks to connected peers, others get it from the update
+// loop once they connect.
+func (r *Reputation) Set(id peer.ID, score float64) {
+	r.mu.Lock()
+	r.peers[id] = &entry{score: clamp(score), updated: time.Now()}
+	r.mu.Unlock()
+	r.updateTag(id)
+}
+
+// Score returns the decayed score with a bonus for low latency peers.
+func (r *Reputation) Score(id peer.ID) float64 {
+	r.mu.Lock()
+	score := 0.0
+	if e, ok := r.peers[id]; ok {
+		e.decay(time.Now())
+		score = e.score
+	}
+	r.mu.Unlock()
+
+	if lat := r.host.Peerstore().LatencyEWMA(id); lat > 0 && lat < time.Second {
+		score += 10 * (1 - float64(lat)/float64(time.Second))
+	}
+	return clamp(score)
+}
+
+func (r *Reputation) add(id peer.ID, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	e, ok := r.peers[id]
+	if !ok {
+		e = &entry{updated: now}
+		r.peers[id] = e
+	}
+	e.decay(now)
+	e.score = clamp(e.score + delta)
+}
+
+func (r *Reputation) updateTag(id peer.ID) {
+	score := r.Score(id)
+
+	r.host.ConnManager().UpsertTag(id, Tag, func(int) int {
+		return int(score) + maxScore
+	})
+	if score >= protectScore {
+		r.host.ConnManager().Protect(id, protectTag)
+	} else {
+		r.host.ConnManager().Unprotect(id, protectTag)
+	}
+}
+
+func (r *Reputation) updateLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.update()
+		}
+	}
+}
+
+// update credits uptime of connected peers, refreshes their tags and forgets
+// peers whose score has decayed to nothing.
+func (r *Reputation) update() {
+	now := time.Now()
+
+	r.mu.Lock()
+	ids := make([]peer.ID, 0, len(r.peers))
+	for id, e := range r.peers {
+		if r.host.Network().Connectedness(id) == network.Connected {
+			ids = append(ids, id)
+			continue
+		}
+		e.decay(now)
+		if math.Abs(e.score) < 0.5 {
+			delete(r.peers, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		r.add(id, uptimeWeight)
+		r.updateTag(id)
+	}
+}
+
+func clamp(score float64) float64 {
+	return math.Max(-maxScore, math.Min(maxScore, score))
+}
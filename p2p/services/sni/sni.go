@@ -0,0 +1,151 @@
+package sni
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DialFunc opens a connection to addr through the mesh.
+type DialFunc func(ctx context.Context, addr string, pin peer.ID) (net.Conn, error)
+
+// Sni is a TLS passthrough listener: it reads the server name from the
+// ClientHello and splices the untouched connection to name:443, routed
+// like the proxy handler routes the host.
+type Sni struct {
+	opts *opts.Options
+	ctx  context.Context
+	dial DialFunc
+
+	ln net.Listener
+}
+
+func NewSni(c *models.SrvCtx, dial DialFunc) *Sni {
+	return &Sni{
+		opts: c.Opts,
+		ctx:  c.Ctx,
+		dial: dial,
+	}
+}
+
+func (s *Sni) Start() error {
+	ln, err := net.Listen("tcp", ":"+s.opts.Server.SNIPort)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(conn)
+		}
+	}()
+
+	log.Println("[SNI] Service started on", ln.Addr())
+	return nil
+}
+
+func (s *Sni) Stop() {
+	log.Println("[SNI] Service stoping...")
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+func (s *Sni) Name() string {
+	return "SNI"
+}
+
+func (s *Sni) ProtocolID() protocol.ID {
+	return ""
+}
+
+func (s *Sni) HandleStream(stream network.Stream) {
+	stream.Close()
+}
+
+func (s *Sni) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	name, hello, err := peekServerName(conn)
+	if err != nil || name == "" {
+		log.Printf("[SNI] No server name from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	addr := net.JoinHostPort(name, "443")
+	remote, err := s.connect(addr, name)
+	if err != nil {
+		log.Printf("[SNI] %s: %v", name, err)
+		return
+	}
+	defer remote.Close()
+
+	if _, err = remote.Write(hello); err != nil {
+		return
+	}
+
+	utils.Splice(conn, remote)
+}
+
+// connect opens the tunnel to addr, the route table decides whether it
+// goes out locally or through the mesh, like for the proxy handler.
+func (s *Sni) connect(addr, name string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+	return s.dial(ctx, addr, "")
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads the ClientHello from conn and returns its server name
+// together with the bytes read, which still have to reach the real server.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var name string
+
+	err := tls.Server(readOnlyConn{io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return name, hello.Bytes(), nil
+}
+
+// readOnlyConn lets crypto/tls parse the ClientHello without ever writing
+// to the client.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
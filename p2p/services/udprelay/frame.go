@@ -0,0 +1,35 @@
+package udprelay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxDatagram is the largest payload a uint16 length frame can carry.
+const maxDatagram = 65535
+
+// writeFrame writes one datagram prefixed with its uint16 length.
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > maxDatagram {
+		return fmt.Errorf("datagram too large: %d", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads one datagram into buf, which must hold maxDatagram bytes.
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
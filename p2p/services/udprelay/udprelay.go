@@ -0,0 +1,287 @@
+package udprelay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const ProtocolID protocol.ID = "/tunsgo/udp/1.0.0"
+
+// UdpRelay carries UDP flows over libp2p streams. A stream is one flow: the
+// client sends "UDP host:port\n", the exit answers "OK\n" and both sides
+// then exchange length prefixed datagrams until the flow is idle.
+type UdpRelay struct {
+	host host.Host
+	opts *opts.Options
+	ctx  context.Context
+
+	hosts  *atomic.Pointer[utils.HostMatcher]
+	routes *models.RouteTable
+	slots  chan struct{}
+	rep    models.Reputation
+
+	// candidates returns the exits allowing a host and having the labels,
+	// best first
+	candidates func(string, *models.LabelSelector) []peer.ID
+}
+
+func NewUdpRelay(c *models.SrvCtx, candidates func(string, *models.LabelSelector) []peer.ID) *UdpRelay {
+	return &UdpRelay{
+		host:       c.Host,
+		opts:       c.Opts,
+		ctx:        c.Ctx,
+		hosts:      &c.Hosts,
+		routes:     c.Routes,
+		slots:      c.Slots,
+		rep:        c.Rep,
+		candidates: candidates,
+	}
+}
+
+func (u *UdpRelay) Start() error {
+	log.Println("[UDP] Service started")
+	return nil
+}
+
+func (u *UdpRelay) Stop() {
+	log.Println("[UDP] Service stoping...")
+}
+
+func (u *UdpRelay) Name() string {
+	return "UdpRelay"
+}
+
+func (u *UdpRelay) ProtocolID() protocol.ID {
+	return ProtocolID
+}
+
+func (u *UdpRelay) idleTimeout() time.Duration {
+	return time.Duration(u.opts.UDP.IdleTimeout) * time.Second
+}
+
+func (u *UdpRelay) HandleStream(stream network.Stream) {
+	defer stream.Close()
+
+	release, err := models.Admit(u.opts, u.slots, stream.Conn().RemotePeer())
+	switch err {
+	case nil:
+		defer release()
+	case models.ErrPeerNotAllowed:
+		fmt.Fprintf(stream, "HTTP/1.1 403 Forbidden\r\n\r\nPeer Not Allowed")
+		return
+	default:
+		fmt.Fprintf(stream, "HTTP/1.1 429 Too Many Requests\r\n\r\nAll slots busy")
+		return
+	}
+
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	targetAddr := strings.TrimPrefix(strings.TrimSpace(line), "UDP ")
+	if _, _, err = net.SplitHostPort(targetAddr); err != nil {
+		fmt.Fprintf(stream, "HTTP/1.1 400 Bad Request\r\n\r\nInvalid Target")
+		return
+	}
+
+	if !u.hosts.Load().Match(targetAddr) {
+		fmt.Fprintf(stream, "HTTP/1.1 403 Forbidden\r\n\r\nHost Not Allowed")
+		return
+	}
+
+	conn, err := net.DialTimeout("udp", targetAddr, 15*time.Second)
+	if err != nil {
+		fmt.Fprintf(stream, "HTTP/1.1 502 Bad Gateway\r\n\r\nFailed to connect to target: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = fmt.Fprintf(stream, "OK\n"); err != nil {
+		return
+	}
+
+	idle := u.idleTimeout()
+	timer := time.AfterFunc(idle, func() {
+		stream.Reset()
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	errChan := make(chan error, 2)
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := readFrame(reader, buf)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			timer.Reset(idle)
+			if _, err = conn.Write(buf[:n]); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			timer.Reset(idle)
+			if err = writeFrame(stream, buf[:n]); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	<-errChan
+}
+
+// Dial opens a UDP flow to addr through an exit, pin forces the exit
+// instead of picking one by its hosts.
+func (u *UdpRelay) Dial(ctx context.Context, addr string, pin peer.ID) (*Flow, error) {
+	hostOnly, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := u.routes.Lookup(addr)
+	switch rule.Action {
+	case opts.RouteBlock:
+		return nil, fmt.Errorf("%s is blocked by route", hostOnly)
+	case opts.RouteDirect, opts.RouteUpstream:
+		return nil, fmt.Errorf("route %s of %s is not supported for udp", rule.Action, hostOnly)
+	}
+	if pin != "" && !rule.AllowsExit(pin) {
+		return nil, fmt.Errorf("route of %s does not allow peer %s", hostOnly, pin)
+	}
+
+	exits := []peer.ID{pin}
+	if pin == "" {
+		exits = exits[:0]
+		for _, id := range u.candidates(addr, rule.Labels) {
+			if rule.AllowsExit(id) && u.supports(id) {
+				exits = append(exits, id)
+			}
+		}
+		if rule.Attempts > 0 && len(exits) > rule.Attempts {
+			exits = exits[:rule.Attempts]
+		}
+	}
+	if len(exits) == 0 {
+		return nil, fmt.Errorf("no proxy nodes available for %s", hostOnly)
+	}
+
+	for _, id := range exits {
+		flow, err := u.dialExit(ctx, id, addr, rule.Timeout)
+		if err != nil {
+			log.Printf("[UDP] Flow to %s via %s failed: %v", addr, id, err)
+			u.rep.Record(id, reputation.ProxyFailure)
+			continue
+		}
+		u.rep.Record(id, reputation.ProxySuccess)
+		return flow, nil
+	}
+	return nil, fmt.Errorf("no nodes available for %s", hostOnly)
+}
+
+// supports reports whether id may speak the UDP protocol, peers that were
+// never identified are tried anyway.
+func (u *UdpRelay) supports(id peer.ID) bool {
+	protos, err := u.host.Peerstore().GetProtocols(id)
+	if err != nil || len(protos) == 0 {
+		return true
+	}
+	for _, p := range protos {
+		if p == ProtocolID {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *UdpRelay) dialExit(ctx context.Context, id peer.ID, addr string, timeout time.Duration) (*Flow, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stream, err := u.host.NewStream(ctx, id, ProtocolID)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	if _, err = fmt.Fprintf(stream, "UDP %s\n", addr); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	if line = strings.TrimSpace(line); line != "OK" {
+		stream.Reset()
+		return nil, fmt.Errorf("exit refused: %s", line)
+	}
+	stream.SetDeadline(time.Time{})
+
+	return &Flow{stream: stream, reader: reader, buf: make([]byte, maxDatagram)}, nil
+}
+
+// Flow is one UDP flow through an exit, every Read and Write carries a
+// whole datagram. Reads and writes may run concurrently with each other
+// but not with themselves.
+type Flow struct {
+	stream network.Stream
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func (f *Flow) Read(b []byte) (int, error) {
+	n, err := readFrame(f.reader, f.buf)
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, f.buf[:n]), nil
+}
+
+func (f *Flow) Write(b []byte) (int, error) {
+	if err := writeFrame(f.stream, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (f *Flow) Close() error {
+	return f.stream.Close()
+}
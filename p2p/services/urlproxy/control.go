@@ -0,0 +1,168 @@
+package urlproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Request headers steering a single request, they never leave the gateway.
+const (
+	hdrPeer        = "X-Tuns-Peer"
+	hdrTimeout     = "X-Tuns-Timeout"
+	hdrNoLocal     = "X-Tuns-No-Local"
+	hdrMaxAttempts = "X-Tuns-Max-Attempts"
+	hdrExitLabels  = "X-Tuns-Exit-Labels"
+)
+
+// control is how one request is routed: the route rule narrowed down by
+// the control headers of the client.
+type control struct {
+	pin      peer.ID
+	timeout  time.Duration
+	noLocal  bool
+	attempts int
+	labels   *models.LabelSelector
+}
+
+// ruleControl is the control of a rule without any request headers.
+func ruleControl(rule *models.RouteRule) *control {
+	return &control{attempts: rule.Attempts, labels: rule.Labels}
+}
+
+// parseControl reads the control headers from h, removes them and merges
+// them with rule. Headers only narrow the rule: attempts are capped and
+// labels are added to the ones of the rule.
+func parseControl(h http.Header, rule *models.RouteRule) (*control, error) {
+	ctl := ruleControl(rule)
+	defer func() {
+		for _, k := range []string{hdrPeer, hdrTimeout, hdrNoLocal, hdrMaxAttempts, hdrExitLabels} {
+			h.Del(k)
+		}
+	}()
+
+	if v := h.Get(hdrPeer); v != "" {
+		id, err := peer.Decode(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", hdrPeer, err)
+		}
+		ctl.pin = id
+	}
+
+	if v := strings.TrimSpace(h.Get(hdrTimeout)); v != "" {
+		// seconds like the config or a duration such as 1500ms
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			secs, serr := strconv.ParseFloat(v, 64)
+			if serr != nil {
+				return nil, fmt.Errorf("invalid %s: %q", hdrTimeout, v)
+			}
+			d = time.Duration(secs * float64(time.Second))
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid %s: %q", hdrTimeout, v)
+		}
+		ctl.timeout = d
+	}
+
+	if v := h.Get(hdrNoLocal); v != "" {
+		noLocal, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", hdrNoLocal, v)
+		}
+		ctl.noLocal = noLocal
+	}
+
+	if v := h.Get(hdrMaxAttempts); v != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid %s: %q", hdrMaxAttempts, v)
+		}
+		if ctl.attempts == 0 || n < ctl.attempts {
+			ctl.attempts = n
+		}
+	}
+
+	labels, err := models.ParseLabelSelector(h.Values(hdrExitLabels)...)
+	if err != nil {
+		return nil, err
+	}
+	ctl.labels = ctl.labels.Merge(labels)
+	return ctl, nil
+}
+
+// diag collects what the X-Tuns-Via, X-Tuns-Attempts and Server-Timing
+// response headers report about a request.
+type diag struct {
+	start    time.Time
+	selected time.Duration
+	attempts int
+	cur      *phase
+}
+
+// phase holds the timings of one attempt, a late callback of a failed
+// attempt only touches its own phase.
+type phase struct {
+	start  time.Time
+	conn   time.Duration
+	first  time.Duration
+	reused bool
+}
+
+func newDiag() *diag {
+	return &diag{start: time.Now()}
+}
+
+// selectDone marks the exits as selected.
+func (d *diag) selectDone() {
+	d.selected = time.Since(d.start)
+}
+
+// begin starts an attempt and returns ctx tracing its connection and
+// first response byte.
+func (d *diag) begin(ctx context.Context) context.Context {
+	ph := &phase{start: time.Now()}
+	d.cur = ph
+	d.attempts++
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			ph.conn = time.Since(ph.start)
+			ph.reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			ph.first = time.Since(ph.start)
+		},
+	})
+}
+
+// write sets the diagnostic headers on the response, via is the exit peer
+// or how the gateway fetched the request itself.
+func (d *diag) write(c *gin.Context, via string) {
+	if via != "" {
+		c.Header("X-Tuns-Via", via)
+	}
+	c.Header("X-Tuns-Attempts", strconv.Itoa(d.attempts))
+
+	timing := []string{fmt.Sprintf("select;dur=%.1f", ms(d.selected))}
+	if d.cur != nil {
+		dial := fmt.Sprintf("dial;dur=%.1f", ms(d.cur.conn))
+		if d.cur.reused {
+			// no dial happened, the time is only the wait for the pool
+			dial += `;desc="reused"`
+		}
+		timing = append(timing, dial, fmt.Sprintf("ttfb;dur=%.1f", ms(d.cur.first)))
+	}
+	c.Header("Server-Timing", strings.Join(timing, ", "))
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,90 @@
+package urlproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Dial opens a raw TCP tunnel to addr the way the route table says, pin
+// forces the exit instead of picking one by its hosts. Exits confirm the
+// tunnel before it is returned, one that refuses or can't reach the target
+// is failed over like an unreachable one.
+func (p *UrlProxy) Dial(ctx context.Context, addr string, pin peer.ID) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := p.routes.Lookup(addr)
+	if pin != "" && !rule.AllowsExit(pin) {
+		return nil, fmt.Errorf("route of %s does not allow peer %s", host, pin)
+	}
+
+	switch rule.Action {
+	case opts.RouteBlock:
+		return nil, fmt.Errorf("%s is blocked by route", host)
+	case opts.RouteDirect:
+		return dialDirect(ctx, addr, rule.Timeout)
+	case opts.RouteUpstream:
+		at := newAttempt(ctx, rule.Timeout)
+		defer at.done()
+		conn, err := dialUpstream(at.ctx, rule.Upstream, addr)
+		return conn, err
+	case opts.RouteLocalThenMesh:
+		if pin == "" {
+			if conn, err := dialDirect(ctx, addr, rule.Timeout); err == nil {
+				return conn, nil
+			}
+		}
+	case "":
+		if pin == "" && p.hosts.Load().Match(addr) {
+			if conn, err := dialDirect(ctx, addr, rule.Timeout); err == nil {
+				return conn, nil
+			}
+		}
+	}
+
+	ctl := ruleControl(rule)
+	ctl.pin = pin
+	routes := p.meshRoutes(addr, rule, ctl)
+
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no proxy nodes available for %s", host)
+	}
+
+	for _, rt := range routes {
+		at := newAttempt(ctx, rule.Timeout)
+		var stream network.Stream
+		if rt.via != "" {
+			stream, err = dialHop(at.ctx, p.host, rt.via, rt.exit, addr)
+		} else {
+			stream, err = dialTunnel(at.ctx, p.host, p.ProtocolID(), rt.exit, addr)
+		}
+		at.done()
+		if err != nil {
+			log.Printf("[HTTP] Tunnel to %s: %v", addr, err)
+			p.rep.Record(rt.target(), reputation.ProxyFailure)
+			continue
+		}
+		p.rep.Record(rt.target(), reputation.ProxySuccess)
+		return &streamConn{stream}, nil
+	}
+	return nil, fmt.Errorf("no nodes available for %s", host)
+}
+
+// dialDirect connects to addr from this node.
+func dialDirect(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	d := net.Dialer{Timeout: timeout}
+	return d.DialContext(ctx, "tcp", addr)
+}
@@ -17,7 +17,11 @@ import (
 
 type contextKey string
 
-const TargetPeerKey contextKey = "p2p-tunsgo-urlproxy"
+const (
+	TargetPeerKey contextKey = "p2p-tunsgo-urlproxy"
+	// ExitPeerKey asks the target peer to forward the connection to this exit
+	ExitPeerKey contextKey = "p2p-tunsgo-urlproxy-exit"
+)
 
 type streamConn struct {
 	network.Stream
@@ -37,34 +41,66 @@ func (s *streamConn) SetDeadline(t time.Time) error      { return s.Stream.SetDe
 func (s *streamConn) SetReadDeadline(t time.Time) error  { return s.Stream.SetReadDeadline(t) }
 func (s *streamConn) SetWriteDeadline(t time.Time) error { return s.Stream.SetWriteDeadline(t) }
 
+// NewP2PClient dials the peer named by TargetPeerKey in the request context.
+// Pooled connections are keyed by the target URL only and would be reused
+// for any peer, so the client never keeps them.
 func NewP2PClient(h host.Host, protoID protocol.ID) *http.Client {
+	tr := newTransport(func(ctx context.Context, addr string) (net.Conn, error) {
+		pID, ok := ctx.Value(TargetPeerKey).(peer.ID)
+		if !ok {
+			return nil, fmt.Errorf("p2p target peer not specified in context")
+		}
+		exit, _ := ctx.Value(ExitPeerKey).(peer.ID)
+		return dialStream(ctx, h, protoID, pID, exit, addr)
+	})
+	tr.DisableKeepAlives = true
+	return &http.Client{Transport: tr}
+}
+
+// NewPeerClient always dials pID, so its pooled connections are safe to reuse.
+func NewPeerClient(h host.Host, protoID protocol.ID, pID peer.ID) *http.Client {
 	return &http.Client{
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				pID, ok := ctx.Value(TargetPeerKey).(peer.ID)
-				if !ok {
-					return nil, fmt.Errorf("p2p target peer not specified in context")
-				}
-
-				stream, err := h.NewStream(ctx, pID, protoID)
-				if err != nil {
-					return nil, err
-				}
-
-				log.Println("[HTTP] Connecting to p2p:", addr)
-				_, err = fmt.Fprintf(stream, "CONNECT %s\n", addr)
-				if err != nil {
-					stream.Reset()
-					return nil, err
-				}
-
-				return &streamConn{stream}, nil
-			},
-
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
+		Transport: newTransport(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialStream(ctx, h, protoID, pID, "", addr)
+		}),
+	}
+}
+
+func newTransport(dial func(ctx context.Context, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, addr)
 		},
+
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
 	}
 }
+
+// dialStream opens a stream to pID and asks it to connect to addr, or to
+// forward the connection to exit when it is set.
+func dialStream(ctx context.Context, h host.Host, protoID protocol.ID, pID, exit peer.ID, addr string) (net.Conn, error) {
+	if exit != "" {
+		log.Printf("[HTTP] Connecting to p2p: %s via %s", addr, pID)
+		stream, err := dialHop(ctx, h, pID, exit, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &streamConn{stream}, nil
+	}
+
+	stream, err := h.NewStream(ctx, pID, protoID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("[HTTP] Connecting to p2p:", addr)
+	if _, err = fmt.Fprintf(stream, "CONNECT %s\n", addr); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	return &streamConn{stream}, nil
+}
@@ -0,0 +1,266 @@
+package urlproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// HopProtocolID is only served by nodes forwarding for others, so its
+// announcement tells consumers which peers can be a middle hop.
+const HopProtocolID protocol.ID = "/tunsgo/hop/1.0.0"
+
+// route is one way to reach the target: straight to the exit, or through
+// the via peer which forwards the stream so the exit never sees our ID.
+type route struct {
+	exit peer.ID
+	via  peer.ID
+}
+
+// target is the peer the stream is opened to.
+func (r route) target() peer.ID {
+	if r.via != "" {
+		return r.via
+	}
+	return r.exit
+}
+
+func (p *UrlProxy) hopRule(targetHost string) *opts.HopRule {
+	for i := range p.opts.MultiHop.Rules {
+		if utils.MatchHost(p.opts.MultiHop.Rules[i].Hosts, targetHost) {
+			return &p.opts.MultiHop.Rules[i]
+		}
+	}
+	return nil
+}
+
+// getRoutes returns the routes to try for targetHost. Hosts matching a
+// multi hop rule only get two hop routes, exits without a usable middle
+// peer are skipped rather than used directly.
+func (p *UrlProxy) getRoutes(targetHost string, labels *models.LabelSelector) []route {
+	exits := p.getCandidateProxies(targetHost, labels)
+
+	rule := p.hopRule(targetHost)
+	if rule == nil {
+		routes := make([]route, len(exits))
+		for i, exit := range exits {
+			routes[i] = route{exit: exit}
+		}
+		return routes
+	}
+
+	middles := p.getMiddles(rule)
+	var routes []route
+	for _, exit := range exits {
+		if len(rule.Exits) > 0 && !utils.AllowedPeer(rule.Exits, nil, exit) {
+			continue
+		}
+		// every middle is a route of its own, a refusing one is failed over
+		for _, via := range middles {
+			if via != exit {
+				routes = append(routes, route{exit: exit, via: via})
+			}
+		}
+	}
+	return routes
+}
+
+// getMiddles lists the peers allowed as middle hop by rule, in the order of
+// the rule or best first without an explicit list. Only peers announcing
+// HopProtocolID are used, nodes that don't forward never announce it.
+func (p *UrlProxy) getMiddles(rule *opts.HopRule) []peer.ID {
+	var ids []peer.ID
+	explicit := len(rule.Middle) > 0
+	if explicit {
+		for _, s := range rule.Middle {
+			if id, err := peer.Decode(s); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	} else {
+		ids = p.host.Network().Peers()
+	}
+
+	res := make([]peer.ID, 0, len(ids))
+	for _, id := range ids {
+		if id == p.host.ID() || !utils.AllowedPeer(p.opts.Access.OnlyUse, p.opts.Access.DenyUse, id) {
+			continue
+		}
+		// listed middles that were never identified are still tried
+		protos, err := p.host.Peerstore().GetProtocols(id)
+		if err != nil || (len(protos) == 0 && explicit) || slices.Contains(protos, HopProtocolID) {
+			res = append(res, id)
+		}
+	}
+
+	if !explicit {
+		sort.SliceStable(res, func(i, j int) bool {
+			return p.rep.Score(res[i]) > p.rep.Score(res[j])
+		})
+	}
+	return res
+}
+
+// loopToken stands in for our peer ID in X-P2P-Server-ID on two hop
+// routes, a request coming back with it is still recognized as a loop.
+func loopToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleHop serves the middle hop: after "FORWARD exit addr" it opens a
+// stream to the exit on behalf of the remote peer, answers "OK" or
+// "ERR reason" and splices both streams together.
+func (p *UrlProxy) handleHop(stream network.Stream) {
+	defer stream.Close()
+
+	release, err := models.Admit(p.opts, p.slots, stream.Conn().RemotePeer())
+	if err != nil {
+		fmt.Fprintf(stream, "ERR %v\n", err)
+		return
+	}
+	defer release()
+
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	inner, err := p.openExit(stream, strings.TrimSpace(line))
+	if err != nil {
+		fmt.Fprintf(stream, "ERR %v\n", err)
+		return
+	}
+	defer inner.Close()
+
+	if _, err = fmt.Fprintf(stream, "OK\n"); err != nil {
+		inner.Reset()
+		return
+	}
+	utils.Splice(utils.WithReader(stream, reader), inner)
+}
+
+// handleForward serves FORWARD requests of older consumers sent on the
+// urlproxy protocol, refusals are reported as plain HTTP errors.
+func (p *UrlProxy) handleForward(stream network.Stream, reader *bufio.Reader, line string) {
+	if !p.opts.MultiHop.Serve {
+		fmt.Fprintf(stream, "HTTP/1.1 403 Forbidden\r\n\r\nForwarding Not Allowed")
+		return
+	}
+
+	inner, err := p.openExit(stream, line)
+	if err != nil {
+		fmt.Fprintf(stream, "HTTP/1.1 502 Bad Gateway\r\n\r\n%v", err)
+		return
+	}
+	defer inner.Close()
+
+	utils.Splice(utils.WithReader(stream, reader), inner)
+}
+
+// openExit parses "FORWARD exit addr" and opens the tunnel to addr through
+// exit, it fails when the exit refuses the target.
+func (p *UrlProxy) openExit(stream network.Stream, line string) (network.Stream, error) {
+	fields := strings.Fields(strings.TrimPrefix(line, "FORWARD "))
+	if !strings.HasPrefix(line, "FORWARD ") || len(fields) != 2 {
+		return nil, errors.New("invalid forward")
+	}
+
+	exit, err := peer.Decode(fields[0])
+	if err != nil || exit == stream.Conn().RemotePeer() || exit == p.host.ID() {
+		return nil, errors.New("invalid exit")
+	}
+	if !utils.AllowedPeer(p.opts.Access.OnlyUse, p.opts.Access.DenyUse, exit) {
+		return nil, errors.New("exit not allowed")
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, 30*time.Second)
+	defer cancel()
+	inner, err := dialTunnel(ctx, p.host, p.ProtocolID(), exit, fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to exit: %w", err)
+	}
+	return inner, nil
+}
+
+// dialTunnel opens a raw tunnel to addr through the exit pID. The exit
+// answers once it reached addr, so a refusal fails the dial.
+func dialTunnel(ctx context.Context, h host.Host, protoID protocol.ID, pID peer.ID, addr string) (network.Stream, error) {
+	stream, err := h.NewStream(ctx, pID, protoID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(stream, "TUNNEL %s\n", addr); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	if err = awaitOK(ctx, stream); err != nil {
+		return nil, fmt.Errorf("exit %s refused: %w", pID, err)
+	}
+	return stream, nil
+}
+
+// dialHop opens a hop stream to via and asks it to forward to exit, a middle
+// that refuses fails the dial so the route counts as a failed attempt.
+func dialHop(ctx context.Context, h host.Host, via, exit peer.ID, addr string) (network.Stream, error) {
+	stream, err := h.NewStream(ctx, via, HopProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(stream, "FORWARD %s %s\n", exit, addr); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	if err = awaitOK(ctx, stream); err != nil {
+		return nil, fmt.Errorf("middle %s refused: %w", via, err)
+	}
+	return stream, nil
+}
+
+// awaitOK reads the "OK" or "ERR reason" answer of a hop or tunnel stream
+// and resets the stream on anything but OK. Exits predating the answer
+// send an HTTP error instead, which fails the same way.
+func awaitOK(ctx context.Context, stream network.Stream) error {
+	if dl, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(dl)
+	}
+
+	// read byte by byte, everything after the answer belongs to the target
+	var reply []byte
+	b := make([]byte, 1)
+	for len(reply) < 512 {
+		if _, err := io.ReadFull(stream, b); err != nil {
+			stream.Reset()
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		reply = append(reply, b[0])
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	if line := strings.TrimSpace(string(reply)); line != "OK" {
+		stream.Reset()
+		return errors.New(strings.TrimPrefix(line, "ERR "))
+	}
+	return nil
+}
@@ -2,23 +2,30 @@ package urlproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
 	"github.com/YouROK/tunsgo/p2p/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 func (p *UrlProxy) GinHandler(c *gin.Context) {
 	selfID := p.host.ID().String()
-	if c.GetHeader("X-P2P-Server-ID") == selfID {
+	serverID := c.GetHeader("X-P2P-Server-ID")
+	if _, looped := p.loops.Load(serverID); serverID == selfID || looped {
 		c.JSON(http.StatusLoopDetected, gin.H{"error": "Infinite loop detected"})
 		return
 	}
@@ -30,44 +37,85 @@ func (p *UrlProxy) GinHandler(c *gin.Context) {
 		return
 	}
 
-	if utils.MatchHost(p.opts.Hosts, u.Hostname()) == true {
+	target := targetAddr(u)
+	rule := p.routes.Lookup(target)
+
+	ctl, err := parseControl(c.Request.Header, rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if ctl.timeout > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), ctl.timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+	}
+
+	if strings.HasSuffix(strings.ToLower(u.Hostname()), opts.TunsSuffix) {
+		p.serveTuns(c, link, u)
+		return
+	}
+
+	dg := newDiag()
+	switch rule.Action {
+	case opts.RouteBlock:
+		c.JSON(http.StatusForbidden, gin.H{"error": "blocked by route"})
+		return
+	case opts.RouteDirect:
+		if !p.fetchDirect(c, http.DefaultClient, link, rule, dg, "direct") {
+			dg.write(c, "")
+			c.JSON(http.StatusBadGateway, gin.H{"error": "direct request failed"})
+		}
+		return
+	case opts.RouteUpstream:
+		if !p.fetchDirect(c, p.upstreamClient(rule.Upstream), link, rule, dg, "upstream") {
+			dg.write(c, "")
+			c.JSON(http.StatusBadGateway, gin.H{"error": "upstream request failed"})
+		}
+		return
+	case opts.RouteLocalThenMesh:
+		if !ctl.noLocal && p.fetchDirect(c, http.DefaultClient, link, rule, dg, "local") {
+			return
+		}
+	case "":
 		//Local request
-		req, err := http.NewRequest(c.Request.Method, link, c.Request.Body)
-		if err == nil {
-			for k, vv := range c.Request.Header {
-				for _, v := range vv {
-					req.Header.Add(k, v)
-				}
-			}
-			req.Header.Set("X-P2P-Server-ID", selfID)
-			resp, err := http.DefaultClient.Do(req)
-			if err == nil {
-				for k, vv := range resp.Header {
-					for _, v := range vv {
-						c.Header(k, v)
-					}
-				}
-				c.Status(resp.StatusCode)
-				io.Copy(c.Writer, resp.Body)
-				resp.Body.Close()
-				return
-			}
+		if !ctl.noLocal && p.hosts.Load().Match(target) && p.fetchDirect(c, http.DefaultClient, link, rule, dg, "local") {
+			return
 		}
 	}
 
-	candidates := p.getCandidateProxies(u.Host)
-	if len(candidates) == 0 {
+	if ctl.pin != "" && !rule.AllowsExit(ctl.pin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "route does not allow the peer"})
+		return
+	}
+
+	routes := p.meshRoutes(target, rule, ctl)
+	dg.selectDone()
+	if len(routes) == 0 {
+		dg.write(c, "")
 		c.JSON(http.StatusBadGateway, gin.H{"error": "no proxy nodes available"})
 		return
 	}
 
-	for _, pID := range candidates {
-		p.peers[pID].LastResp = time.Now()
+	for _, rt := range routes {
+		p.muPeers.Lock()
+		if info, ok := p.peers[rt.exit]; ok {
+			info.LastResp = time.Now()
+		}
+		p.muPeers.Unlock()
 
-		ctx := context.WithValue(c.Request.Context(), TargetPeerKey, pID)
+		pID := rt.target()
+		at := newAttempt(c.Request.Context(), rule.Timeout)
+		ctx := context.WithValue(dg.begin(at.ctx), TargetPeerKey, pID)
+		client := p.peerClient(p.ProtocolID(), pID)
+		if rt.via != "" {
+			ctx = context.WithValue(ctx, ExitPeerKey, rt.exit)
+			client = p.hopClient
+		}
 
 		req, err := http.NewRequestWithContext(ctx, c.Request.Method, link, c.Request.Body)
 		if err != nil {
+			at.done()
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -78,53 +126,167 @@ func (p *UrlProxy) GinHandler(c *gin.Context) {
 			}
 		}
 
-		req.Header.Set("X-P2P-Server-ID", selfID)
-		resp, err := p.httpClient.Do(req)
+		// the exit must not learn our ID from the header on two hop routes
+		serverID := selfID
+		if rt.via != "" {
+			serverID = loopToken()
+			p.loops.Store(serverID, struct{}{})
+		}
+		req.Header.Set("X-P2P-Server-ID", serverID)
+		resp, err := client.Do(req)
+		if serverID != selfID {
+			defer p.loops.Delete(serverID)
+		}
+		at.started()
 		if err != nil {
-			p.host.ConnManager().UpsertTag(pID, "tuns-node", func(current int) int {
-				if current > 10 {
-					return current - 10
-				}
-				return 0
-			})
+			at.done()
+			p.rep.Record(pID, reputation.ProxyFailure)
 			if resp != nil && resp.Body != nil {
 				resp.Body.Close()
 			}
 			continue
 		}
-		log.Printf("[REQ] Request to %s link: %s", pID.String(), link)
+		if rt.via != "" {
+			log.Printf("[REQ] Request to %s via %s link: %s", rt.exit.String(), rt.via.String(), link)
+			c.Header("X-Tuns-Hop", rt.via.String())
+		} else {
+			log.Printf("[REQ] Request to %s link: %s", pID.String(), link)
+		}
 
 		for k, vv := range resp.Header {
 			for _, v := range vv {
 				c.Header(k, v)
 			}
 		}
+		dg.write(c, rt.exit.String())
 		c.Status(resp.StatusCode)
 		io.Copy(c.Writer, resp.Body)
 		resp.Body.Close()
-		p.host.ConnManager().UpsertTag(pID, "tuns-node", func(current int) int {
-			return 100
-		})
+		at.done()
+		p.rep.Record(pID, reputation.ProxySuccess)
+		return
+	}
+	dg.write(c, "")
+	if errors.Is(c.Request.Context().Err(), context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "request timed out"})
 		return
 	}
 	c.JSON(http.StatusInternalServerError, gin.H{"error": "No nodes available"})
 	return
 }
 
-func (p *UrlProxy) getCandidateProxies(targetHost string) []peer.ID {
+// fetchDirect does the request from this node with client and reports
+// whether a response was written, via names the way in X-Tuns-Via.
+func (p *UrlProxy) fetchDirect(c *gin.Context, client *http.Client, link string, rule *models.RouteRule, dg *diag, via string) bool {
+	at := newAttempt(c.Request.Context(), rule.Timeout)
+	defer at.done()
+
+	dg.selectDone()
+	req, err := http.NewRequestWithContext(dg.begin(at.ctx), c.Request.Method, link, c.Request.Body)
+	if err != nil {
+		return false
+	}
+	for k, vv := range c.Request.Header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("X-P2P-Server-ID", p.host.ID().String())
+
+	resp, err := client.Do(req)
+	at.started()
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			c.Header(k, v)
+		}
+	}
+	dg.write(c, via)
+	c.Status(resp.StatusCode)
+	io.Copy(c.Writer, resp.Body)
+	return true
+}
+
+// meshRoutes returns the routes to target the rule and ctl allow, at most
+// ctl.attempts of them. A pinned exit that has not announced target yet is
+// tried directly unless a multi-hop rule covers target.
+func (p *UrlProxy) meshRoutes(target string, rule *models.RouteRule, ctl *control) []route {
+	labels := ctl.labels
+	if ctl.pin != "" {
+		// the pin was picked by hand, labels don't apply to it
+		labels = nil
+	}
+
+	p.muPeers.RLock()
+	all := p.getRoutes(target, labels)
+	p.muPeers.RUnlock()
+
+	routes := all[:0]
+	for _, rt := range all {
+		if rule.AllowsExit(rt.exit) && (ctl.pin == "" || rt.exit == ctl.pin) {
+			routes = append(routes, rt)
+		}
+	}
+	if ctl.pin != "" && len(routes) == 0 && p.hopRule(target) == nil {
+		routes = append(routes, route{exit: ctl.pin})
+	}
+	if ctl.attempts > 0 && len(routes) > ctl.attempts {
+		routes = routes[:ctl.attempts]
+	}
+	return routes
+}
+
+// Candidates returns the exits allowing targetHost and having the labels,
+// best first.
+func (p *UrlProxy) Candidates(targetHost string, labels *models.LabelSelector) []peer.ID {
+	p.muPeers.RLock()
+	defer p.muPeers.RUnlock()
+	return p.getCandidateProxies(targetHost, labels)
+}
+
+func (p *UrlProxy) getCandidateProxies(targetHost string, labels *models.LabelSelector) []peer.ID {
 	type candidate struct {
-		id   peer.ID
-		last time.Time
+		id      peer.ID
+		rank    int
+		relayed bool
+		score   int
+		last    time.Time
 	}
 	var list []candidate
 
-	for pID, info := range p.peers {
-		if utils.MatchHost(info.Hosts, targetHost) {
-			list = append(list, candidate{pID, info.LastResp})
+	for _, pID := range p.index.Lookup(targetHost) {
+		info, ok := p.peers[pID]
+		if !ok || !utils.AllowedPeer(p.opts.Access.OnlyUse, p.opts.Access.DenyUse, pID) {
+			continue
+		}
+		if info.Matcher().Match(targetHost) && labels.Matches(info.Labels) {
+			// scores are bucketed so peers of similar quality take turns
+			list = append(list, candidate{
+				id:      pID,
+				rank:    labels.Rank(info.Labels),
+				relayed: p.host.Network().Connectedness(pID) == network.Limited,
+				score:   int(p.rep.Score(pID)) / 10,
+				last:    info.LastResp,
+			})
 		}
 	}
 
+	// exits with more preferred labels go first, the ones reachable only
+	// through a relay go last
 	sort.Slice(list, func(i, j int) bool {
+		if list[i].rank != list[j].rank {
+			return list[i].rank > list[j].rank
+		}
+		if list[i].relayed != list[j].relayed {
+			return !list[i].relayed
+		}
+		if list[i].score != list[j].score {
+			return list[i].score > list[j].score
+		}
 		return list[i].last.Before(list[j].last)
 	})
 
@@ -135,6 +297,18 @@ func (p *UrlProxy) getCandidateProxies(targetHost string) []peer.ID {
 	return result
 }
 
+// targetAddr returns host:port of u, the port defaults to the scheme one.
+func targetAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
 func isLocalSelf(u *url.URL, selfPort int) bool {
 	host := u.Hostname()
 	if host == "localhost" || host == "127.0.0.1" || host == "0.0.0.0" {
@@ -3,11 +3,11 @@ package urlproxy
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/YouROK/tunsgo/p2p/models"
 	"github.com/YouROK/tunsgo/p2p/utils"
 	"github.com/libp2p/go-libp2p/core/network"
 )
@@ -15,14 +15,13 @@ import (
 func (p *UrlProxy) HandleStream(stream network.Stream) {
 	defer stream.Close()
 
-	select {
-	case p.slots <- struct{}{}:
-		defer func() {
-			go func() {
-				time.Sleep(time.Duration(p.opts.Server.SlotSleep) * time.Second)
-				<-p.slots
-			}()
-		}()
+	release, err := models.Admit(p.opts, p.slots, stream.Conn().RemotePeer())
+	switch err {
+	case nil:
+		defer release()
+	case models.ErrPeerNotAllowed:
+		fmt.Fprintf(stream, "HTTP/1.1 403 Forbidden\r\n\r\nPeer Not Allowed")
+		return
 	default:
 		fmt.Fprintf(stream, "HTTP/1.1 429 Too Many Requests\r\n\r\nAll slots busy")
 		return
@@ -35,36 +34,44 @@ func (p *UrlProxy) HandleStream(stream network.Stream) {
 		return
 	}
 
-	targetAddr := strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "FORWARD ") {
+		p.handleForward(stream, reader, line)
+		return
+	}
 
-	hostOnly, _, _ := net.SplitHostPort(targetAddr)
-	if hostOnly == "" {
-		hostOnly = targetAddr
+	// TUNNEL wants "OK" or "ERR reason" before the splice, CONNECT gets
+	// refusals as HTTP errors the http client reads as the response
+	targetAddr, tunnel := strings.CutPrefix(line, "TUNNEL ")
+	if !tunnel {
+		targetAddr = strings.TrimPrefix(line, "CONNECT ")
+	}
+	refuse := func(status, msg string) {
+		if tunnel {
+			fmt.Fprintf(stream, "ERR %s\n", msg)
+		} else {
+			fmt.Fprintf(stream, "HTTP/1.1 %s\r\n\r\n%s", status, msg)
+		}
 	}
 
-	if !utils.MatchHost(p.opts.Hosts, hostOnly) {
-		fmt.Fprintf(stream, "HTTP/1.1 403 Forbidden\r\n\r\nHost Not Allowed")
+	if !p.hosts.Load().Match(targetAddr) {
+		refuse("403 Forbidden", "Host Not Allowed")
 		return
 	}
 
 	conn, err := net.DialTimeout("tcp", targetAddr, 15*time.Second)
 	if err != nil {
-		fmt.Fprintf(stream, "HTTP/1.1 502 Bad Gateway\r\n\r\nFailed to connect to target: %v", err)
+		refuse("502 Bad Gateway", fmt.Sprintf("Failed to connect to target: %v", err))
 		return
 	}
 
-	errChan := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(conn, reader)
-		errChan <- err
-	}()
+	defer conn.Close()
 
-	go func() {
-		_, err := io.Copy(stream, conn)
-		errChan <- err
-	}()
+	if tunnel {
+		if _, err = fmt.Fprintf(stream, "OK\n"); err != nil {
+			return
+		}
+	}
 
-	<-errChan
-	conn.Close()
-	<-errChan
+	utils.Splice(utils.WithReader(stream, reader), conn)
 }
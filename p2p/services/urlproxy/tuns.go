@@ -0,0 +1,81 @@
+package urlproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/YouROK/tunsgo/p2p/services/publish"
+	"github.com/YouROK/tunsgo/p2p/services/reputation"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// serveTuns proxies a request to a service published as <name>.<owner>.tuns.
+func (p *UrlProxy) serveTuns(c *gin.Context, link string, u *url.URL) {
+	peers := p.getPublishers(u.Hostname())
+	if len(peers) == 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "service is not published"})
+		return
+	}
+
+	for _, pID := range peers {
+		ctx := context.WithValue(c.Request.Context(), TargetPeerKey, pID)
+		req, err := http.NewRequestWithContext(ctx, c.Request.Method, link, c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for k, vv := range c.Request.Header {
+			for _, v := range vv {
+				req.Header.Add(k, v)
+			}
+		}
+
+		resp, err := p.peerClient(publish.ProtocolID, pID).Do(req)
+		if err != nil {
+			p.rep.Record(pID, reputation.ProxyFailure)
+			continue
+		}
+		log.Printf("[REQ] Request to %s service link: %s", pID.String(), link)
+
+		for k, vv := range resp.Header {
+			for _, v := range vv {
+				c.Header(k, v)
+			}
+		}
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
+		resp.Body.Close()
+		p.rep.Record(pID, reputation.ProxySuccess)
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "No nodes available"})
+}
+
+// getPublishers returns the owner named in name when it announces name
+// literally. Other peers announcing it are ignored, so names can't be taken
+// over, and host patterns like "*" never match published services.
+func (p *UrlProxy) getPublishers(name string) []peer.ID {
+	name = strings.ToLower(name)
+	pID, ok := publish.Publisher(name)
+	if !ok || !utils.AllowedPeer(p.opts.Access.OnlyUse, p.opts.Access.DenyUse, pID) {
+		return nil
+	}
+
+	p.muPeers.RLock()
+	defer p.muPeers.RUnlock()
+
+	if info, ok := p.peers[pID]; ok {
+		for _, h := range info.Hosts {
+			if strings.ToLower(h) == name {
+				return []peer.ID{pID}
+			}
+		}
+	}
+	return nil
+}
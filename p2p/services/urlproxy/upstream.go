@@ -0,0 +1,136 @@
+package urlproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// attempt bounds one try until the response headers or the tunnel are
+// there, the body may take longer. A zero timeout never cancels it.
+type attempt struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+func newAttempt(parent context.Context, timeout time.Duration) *attempt {
+	ctx, cancel := context.WithCancel(parent)
+	a := &attempt{ctx: ctx, cancel: cancel}
+	if timeout > 0 {
+		a.timer = time.AfterFunc(timeout, cancel)
+	}
+	return a
+}
+
+// started stops the timeout once the attempt got an answer.
+func (a *attempt) started() {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+}
+
+func (a *attempt) done() {
+	a.started()
+	a.cancel()
+}
+
+// upstreamClient returns the http client sending requests through u.
+func (p *UrlProxy) upstreamClient(u *url.URL) *http.Client {
+	if c, ok := p.upstreams.Load(u.String()); ok {
+		return c.(*http.Client)
+	}
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyURL(u),
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+	actual, _ := p.upstreams.LoadOrStore(u.String(), c)
+	return actual.(*http.Client)
+}
+
+// dialUpstream opens a tunnel to addr through the socks5 or http proxy u.
+func dialUpstream(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http":
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream refused: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufConn keeps the bytes read past the CONNECT answer.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -5,9 +5,11 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/YouROK/tunsgo/opts"
 	"github.com/YouROK/tunsgo/p2p/models"
+	"github.com/YouROK/tunsgo/p2p/utils"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -20,10 +22,23 @@ type UrlProxy struct {
 
 	slots chan struct{}
 
-	httpClient *http.Client
+	// clients pool connections per peer and protocol, a shared pool would
+	// hand a request to whichever peer's connection happens to be idle
+	clients sync.Map
+	// hopClient never reuses connections, a pooled one could skip the middle peer
+	hopClient *http.Client
+	// loops holds the X-P2P-Server-ID tokens of requests in flight on two hop routes
+	loops sync.Map
+
+	hosts  *atomic.Pointer[utils.HostMatcher]
+	routes *models.RouteTable
+	// upstreams caches the http clients of upstream proxies by URL
+	upstreams sync.Map
 
 	peers   map[peer.ID]*models.PeerInfo
+	index   *models.HostIndex
 	muPeers *sync.RWMutex
+	rep     models.Reputation
 }
 
 func NewUrlProxy(c *models.SrvCtx) *UrlProxy {
@@ -32,21 +47,49 @@ func NewUrlProxy(c *models.SrvCtx) *UrlProxy {
 		opts:    c.Opts,
 		ctx:     c.Ctx,
 		slots:   c.Slots,
+		hosts:   &c.Hosts,
+		routes:  c.Routes,
 		peers:   c.Peers,
+		index:   c.Index,
 		muPeers: &c.MuPeers,
+		rep:     c.Rep,
 	}
 }
 
 func (p *UrlProxy) Start() error {
 	log.Println("[UrlProxy] Service started")
 
-	p.httpClient = NewP2PClient(p.host, p.ProtocolID())
+	p.hopClient = NewP2PClient(p.host, p.ProtocolID())
+	// only roles serving proxy streams forward them for others
+	if p.opts.MultiHop.Serve && p.opts.Profile().Exit {
+		p.host.SetStreamHandler(HopProtocolID, p.handleHop)
+	}
 
 	return nil
 }
 
 func (p *UrlProxy) Stop() {
 	log.Println("[UrlProxy] Service stoping...")
+	p.host.RemoveStreamHandler(HopProtocolID)
+	p.clients.Range(func(_, c any) bool {
+		c.(*http.Client).CloseIdleConnections()
+		return true
+	})
+}
+
+type clientKey struct {
+	proto protocol.ID
+	peer  peer.ID
+}
+
+// peerClient returns the pooled client for protoID streams to pID.
+func (p *UrlProxy) peerClient(protoID protocol.ID, pID peer.ID) *http.Client {
+	key := clientKey{protoID, pID}
+	if c, ok := p.clients.Load(key); ok {
+		return c.(*http.Client)
+	}
+	c, _ := p.clients.LoadOrStore(key, NewPeerClient(p.host, protoID, pID))
+	return c.(*http.Client)
 }
 
 func (p *UrlProxy) Name() string {
@@ -2,10 +2,12 @@ package p2p
 
 import (
 	"maps"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/YouROK/tunsgo/p2p/models"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
@@ -14,11 +16,20 @@ type PeerDetail struct {
 	Addrs     []string  `json:"addrs"`
 	IsTuns    bool      `json:"is_tuns"`
 	Latency   string    `json:"latency"`
+	Score     float64   `json:"score"`
 	LastSeen  time.Time `json:"last_seen,omitempty"`
 	Protocols []string  `json:"protocols"`
 	Hosts     []string  `json:"hosts,omitempty"`
 }
 
+type NetworkStatus struct {
+	Reachability    string            `json:"reachability"`
+	NATDeviceTypes  map[string]string `json:"nat_device_types"`
+	RelayAddrs      []string          `json:"relay_addrs"`
+	HasReservations bool              `json:"has_reservations"`
+	DHTServer       bool              `json:"dht_server"`
+}
+
 type P2PStatus struct {
 	PeerID         string              `json:"peer_id"`
 	ListenAddrs    []string            `json:"listen_addrs"`
@@ -28,6 +39,22 @@ type P2PStatus struct {
 	Peers          []*PeerDetail       `json:"peers_list"`
 	ConnectedPeers []*PeerDetail       `json:"connected_peers_list"`
 	OurPeers       []*models.PeerInfo  `json:"our_peers_list"`
+	Resources      *ResourceStatus     `json:"resources"`
+	Network        *NetworkStatus      `json:"network"`
+}
+
+func (s *P2PServer) networkStatus() *NetworkStatus {
+	s.muNetState.RLock()
+	st := &NetworkStatus{
+		Reachability:    s.netState.Reachability,
+		NATDeviceTypes:  maps.Clone(s.netState.NATDeviceTypes),
+		RelayAddrs:      slices.Clone(s.netState.RelayAddrs),
+		HasReservations: len(s.netState.RelayAddrs) > 0,
+	}
+	s.muNetState.RUnlock()
+
+	st.DHTServer = slices.Contains(s.host.Mux().Protocols(), dht.ProtocolDHT)
+	return st
 }
 
 func (s *P2PServer) Status() *P2PStatus {
@@ -36,6 +63,8 @@ func (s *P2PServer) Status() *P2PStatus {
 		TotalConns:   len(s.host.Network().Peers()),
 		KnownDomains: make(map[string][]string),
 		Peers:        []*PeerDetail{},
+		Resources:    s.resourcesStatus(),
+		Network:      s.networkStatus(),
 	}
 
 	for _, addr := range s.host.Addrs() {
@@ -71,8 +100,12 @@ func (s *P2PServer) Status() *P2PStatus {
 		detail := &PeerDetail{
 			ID:        pID.String(),
 			IsTuns:    isOurNode,
+			Latency:   s.host.Peerstore().LatencyEWMA(pID).String(),
 			Protocols: protocolsString,
 		}
+		if isOurNode {
+			detail.Score = s.srvctx.Rep.Score(pID)
+		}
 
 		for _, a := range s.host.Peerstore().Addrs(pID) {
 			detail.Addrs = append(detail.Addrs, a.String())
@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/YouROK/tunsgo/opts"
+	"github.com/YouROK/tunsgo/p2p/utils"
+	"github.com/libp2p/go-libp2p"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	libp2pwebrtc "github.com/libp2p/go-libp2p/p2p/transport/webrtc"
+	ws "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// transportOptions builds the libp2p transports enabled in the config and
+// the listen addresses served by them. Addresses of disabled transports are
+// skipped, so the default address list works with any set of switches.
+func transportOptions(o *opts.Options) ([]libp2p.Option, error) {
+	tr := o.P2P.Transports
+
+	var res []libp2p.Option
+	if tr.TCP {
+		res = append(res, libp2p.Transport(tcp.NewTCPTransport))
+	}
+	if tr.QUIC {
+		res = append(res, libp2p.Transport(quic.NewTransport))
+	}
+	if tr.WebTransport {
+		res = append(res, libp2p.Transport(webtransport.New))
+	}
+	if tr.WebSocket {
+		res = append(res, libp2p.Transport(ws.New))
+	}
+	if tr.WebRTC {
+		res = append(res, libp2p.Transport(libp2pwebrtc.New))
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no p2p transports enabled")
+	}
+
+	var addrs []multiaddr.Multiaddr
+	for _, s := range o.P2P.ListenAddrs {
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", s, err)
+		}
+		if transportEnabled(tr, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen addresses for the enabled transports")
+	}
+
+	return append(res, libp2p.ListenAddrs(addrs...)), nil
+}
+
+func transportEnabled(tr opts.Transports, addr multiaddr.Multiaddr) bool {
+	has := func(code int) bool {
+		_, err := addr.ValueForProtocol(code)
+		return err == nil
+	}
+
+	switch {
+	case has(multiaddr.P_WS) || has(multiaddr.P_WSS):
+		return tr.WebSocket
+	case has(multiaddr.P_WEBTRANSPORT):
+		return tr.WebTransport
+	case has(multiaddr.P_WEBRTC_DIRECT):
+		return tr.WebRTC
+	case has(multiaddr.P_QUIC_V1):
+		return tr.QUIC
+	case has(multiaddr.P_TCP):
+		return tr.TCP
+	}
+	return false
+}
+
+// addrsFactory controls the addresses we advertise through identify, pex and
+// the DHT: announce_addrs replace the detected ones, append_addrs are added
+// to them and everything inside filter_cidrs is dropped.
+func addrsFactory(o *opts.Options) (func([]multiaddr.Multiaddr) []multiaddr.Multiaddr, []*net.IPNet, error) {
+	parse := func(list []string) ([]multiaddr.Multiaddr, error) {
+		res := make([]multiaddr.Multiaddr, 0, len(list))
+		for _, s := range list {
+			addr, err := multiaddr.NewMultiaddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", s, err)
+			}
+			res = append(res, addr)
+		}
+		return res, nil
+	}
+
+	announce, err := parse(o.P2P.AnnounceAddrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	extra, err := parse(o.P2P.AppendAddrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	filters, err := utils.ParseCIDRs(o.P2P.FilterCIDRs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	factory := func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+		if len(announce) > 0 {
+			addrs = announce
+		}
+		res := make([]multiaddr.Multiaddr, 0, len(addrs)+len(extra))
+		res = append(res, addrs...)
+		res = append(res, extra...)
+		return utils.FilterAddrs(res, filters)
+	}
+	return factory, filters, nil
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// cidrPresets are names usable in place of a CIDR in address filters.
+var cidrPresets = map[string][]string{
+	"loopback":  {"127.0.0.0/8", "::1/128"},
+	"linklocal": {"169.254.0.0/16", "fe80::/10"},
+	"private":   {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	"docker":    {"172.17.0.0/16", "172.18.0.0/15", "172.20.0.0/14", "172.24.0.0/13"},
+	"cgnat":     {"100.64.0.0/10"},
+}
+
+// ParseCIDRs parses CIDRs and preset names (loopback, linklocal, private,
+// docker, cgnat) into networks.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, s := range list {
+		cidrs, ok := cidrPresets[s]
+		if !ok {
+			cidrs = []string{s}
+		}
+		for _, c := range cidrs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", s, err)
+			}
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+// FilterAddrs drops the addresses with an ip inside one of nets. Addresses
+// without an ip, like dns ones, are kept.
+func FilterAddrs(addrs []multiaddr.Multiaddr, nets []*net.IPNet) []multiaddr.Multiaddr {
+	if len(nets) == 0 {
+		return addrs
+	}
+	res := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if !inNets(a, nets) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+func inNets(addr multiaddr.Multiaddr, nets []*net.IPNet) bool {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,25 +1,227 @@
 package utils
 
-import "strings"
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 
+	"golang.org/x/net/idna"
+)
+
+// MatchHost reports whether target, a host name or IP with an optional
+// port, is allowed by patterns. Patterns are:
+//
+//	example.com       exactly example.com
+//	*.example.com     subdomains of example.com only
+//	.example.com      example.com and its subdomains
+//	*example.com      legacy form of .example.com
+//	*, *:443          any host
+//	10.0.0.0/8        IP literal targets inside the network, single IPs too
+//	~^api[0-9]+\.x$   regular expression on the host name
+//	!ads.example.com  never match, negations win over every other pattern
+//
+// Host and IP patterns take an optional port, example.com:443 or
+// [2001:db8::/32]:443, which only restricts targets carrying a port.
+// Names are compared lowercase in their punycode form.
 func MatchHost(patterns []string, target string) bool {
-	target = strings.ToLower(target)
+	host, port := splitTarget(target)
+
+	matched := false
 	for _, pattern := range patterns {
-		pattern = strings.ToLower(pattern)
+		neg := strings.HasPrefix(pattern, "!")
+		if neg {
+			pattern = pattern[1:]
+		}
+		if !matchPattern(pattern, host, port) {
+			continue
+		}
+		if neg {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
 
-		if pattern == target || pattern == "*" {
-			return true
+// ValidHostPattern reports why pattern can never match, nil if it is fine.
+func ValidHostPattern(pattern string) error {
+	p := strings.TrimPrefix(pattern, "!")
+	if strings.HasPrefix(p, "~") {
+		if _, err := regexp.Compile(p[1:]); err != nil {
+			return fmt.Errorf("invalid host pattern %q: %v", pattern, err)
 		}
+		return nil
+	}
 
-		if strings.HasPrefix(pattern, "*") {
-			suffix := pattern[1:]
-			if strings.HasPrefix(pattern, ".") {
-				suffix = suffix[1:]
-			}
-			if strings.HasSuffix(target, suffix) {
-				return true
+	p, port := splitPattern(p)
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port in host pattern %q", pattern)
+		}
+	}
+
+	switch {
+	case p == "" || p == "." || p == "*.":
+		return fmt.Errorf("empty host pattern %q", pattern)
+	case strings.Contains(p, "/"):
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			return fmt.Errorf("invalid network in host pattern %q", pattern)
+		}
+	case strings.Contains(strings.TrimPrefix(p, "*"), "*"):
+		return fmt.Errorf("wildcard is only allowed at the start of host pattern %q", pattern)
+	}
+	return nil
+}
+
+// CheckHostPatterns validates every pattern of the list.
+func CheckHostPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if err := ValidHostPattern(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Limits of the regular expressions in host lists of other peers, every
+// record holds its own compiled copies.
+const (
+	MaxRemoteRegexps   = 16
+	MaxRemoteRegexpLen = 256
+)
+
+// CheckRemotePatterns validates a host list received from another peer,
+// which unlike our own lists may only carry a few short regexps.
+func CheckRemotePatterns(patterns []string) error {
+	count := 0
+	for _, p := range patterns {
+		expr, ok := strings.CutPrefix(strings.TrimPrefix(p, "!"), "~")
+		if !ok {
+			continue
+		}
+		if count++; count > MaxRemoteRegexps {
+			return fmt.Errorf("more than %d regexp host patterns", MaxRemoteRegexps)
+		}
+		if len(expr) > MaxRemoteRegexpLen {
+			return fmt.Errorf("regexp host pattern longer than %d bytes", MaxRemoteRegexpLen)
+		}
+	}
+	return CheckHostPatterns(patterns)
+}
+
+func matchPattern(pattern, host, port string) bool {
+	if strings.HasPrefix(pattern, "~") {
+		re := hostRegexp(pattern[1:])
+		return re != nil && re.MatchString(host)
+	}
+
+	pattern, pport := splitPattern(pattern)
+	if pport != "" && port != "" && pport != port {
+		return false
+	}
+
+	switch {
+	case pattern == "*":
+		return true
+	case strings.Contains(pattern, "/"):
+		_, network, err := net.ParseCIDR(pattern)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && network.Contains(ip)
+	case net.ParseIP(pattern) != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && ip.Equal(net.ParseIP(pattern))
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, normalizeName(pattern[1:]))
+	case strings.HasPrefix(pattern, "."):
+		base := normalizeName(pattern[1:])
+		return host == base || strings.HasSuffix(host, "."+base)
+	case strings.HasPrefix(pattern, "*"):
+		base := normalizeName(strings.TrimPrefix(pattern[1:], "."))
+		return host == base || strings.HasSuffix(host, "."+base)
+	}
+	return host == normalizeName(pattern)
+}
+
+// splitTarget splits an optional port off target and normalizes the host.
+func splitTarget(target string) (string, string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]"), ""
+	}
+	if maybeIP(host) {
+		if _, err := netip.ParseAddr(host); err == nil {
+			return host, port
+		}
+	}
+	return normalizeName(host), port
+}
+
+// maybeIP cheaply tells names from IP literals, parse errors allocate.
+func maybeIP(host string) bool {
+	return host != "" && (host[0] >= '0' && host[0] <= '9' || strings.IndexByte(host, ':') >= 0)
+}
+
+func splitPattern(pattern string) (string, string) {
+	if host, port, err := net.SplitHostPort(pattern); err == nil {
+		return host, port
+	}
+	return pattern, ""
+}
+
+// normalizeName lowercases name, drops the root dot and converts IDN
+// labels to punycode.
+func normalizeName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			if ascii, err := idna.ToASCII(name); err == nil {
+				return ascii
 			}
+			break
+		}
+	}
+	return name
+}
+
+// maxCachedRegexps bounds the cache of MatchHost, compiled matchers keep
+// their own regexps and never use it.
+const maxCachedRegexps = 256
+
+var (
+	regexps   = make(map[string]*regexp.Regexp)
+	muRegexps sync.RWMutex
+)
+
+// compileHostRegexp compiles expr anchored to the whole host name, nil for
+// invalid expressions which never match.
+func compileHostRegexp(expr string) *regexp.Regexp {
+	re, _ := regexp.Compile("^(?:" + expr + ")$")
+	return re
+}
+
+// hostRegexp is compileHostRegexp cached for MatchHost. A full cache drops
+// an arbitrary entry, MatchHost only sees the few lists of our config.
+func hostRegexp(expr string) *regexp.Regexp {
+	muRegexps.RLock()
+	re, ok := regexps[expr]
+	muRegexps.RUnlock()
+	if ok {
+		return re
+	}
+
+	re = compileHostRegexp(expr)
+	muRegexps.Lock()
+	if len(regexps) >= maxCachedRegexps {
+		for k := range regexps {
+			delete(regexps, k)
+			break
 		}
 	}
-	return false
+	regexps[expr] = re
+	muRegexps.Unlock()
+	return re
 }
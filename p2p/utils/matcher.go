@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// HostMatcher is a compiled list of host patterns, it matches like
+// MatchHost without rescanning the patterns. Names live in a trie of
+// reversed labels, so a lookup costs one map access per target label.
+type HostMatcher struct {
+	patterns []string
+	allow    matchSet
+	deny     matchSet
+}
+
+type matchSet struct {
+	root    *labelNode
+	any     *portRule
+	prefixs []prefixRule
+	regexps []*regexp.Regexp
+}
+
+type labelNode struct {
+	children map[string]*labelNode
+	// exact matches the name of the node, sub its strict subdomains
+	exact *portRule
+	sub   *portRule
+}
+
+// portRule is the set of ports a pattern allows, all means any port.
+type portRule struct {
+	all   bool
+	ports map[string]bool
+}
+
+type prefixRule struct {
+	prefix netip.Prefix
+	port   string
+}
+
+// CompileHosts builds a matcher of patterns, invalid ones never match.
+func CompileHosts(patterns []string) *HostMatcher {
+	m := &HostMatcher{patterns: patterns}
+	for _, pattern := range patterns {
+		set := &m.allow
+		if strings.HasPrefix(pattern, "!") {
+			set = &m.deny
+			pattern = pattern[1:]
+		}
+		set.add(pattern)
+	}
+	return m
+}
+
+// Match reports whether target, a host name or IP with an optional port,
+// is allowed. It is safe for concurrent use.
+func (m *HostMatcher) Match(target string) bool {
+	if m == nil {
+		return false
+	}
+	host, port := splitTarget(target)
+	return !m.deny.match(host, port) && m.allow.match(host, port)
+}
+
+// MatchSpecific is Match ignoring the bare * and *:port patterns, for
+// callers that only want the hosts a list actually names.
+func (m *HostMatcher) MatchSpecific(target string) bool {
+	if m == nil {
+		return false
+	}
+	host, port := splitTarget(target)
+	return !m.deny.match(host, port) && m.allow.matchNamed(host, port)
+}
+
+// Patterns returns the patterns the matcher was compiled from.
+func (m *HostMatcher) Patterns() []string {
+	if m == nil {
+		return nil
+	}
+	return m.patterns
+}
+
+func (s *matchSet) add(pattern string) {
+	if strings.HasPrefix(pattern, "~") {
+		if re := compileHostRegexp(pattern[1:]); re != nil {
+			s.regexps = append(s.regexps, re)
+		}
+		return
+	}
+
+	pattern, port := splitPattern(pattern)
+	switch {
+	case pattern == "*":
+		s.any = s.any.with(port)
+		return
+	case strings.Contains(pattern, "/"):
+		if prefix, err := netip.ParsePrefix(pattern); err == nil {
+			s.prefixs = append(s.prefixs, prefixRule{prefix.Masked(), port})
+		}
+		return
+	}
+	if addr, err := netip.ParseAddr(pattern); err == nil {
+		s.prefixs = append(s.prefixs, prefixRule{netip.PrefixFrom(addr, addr.BitLen()), port})
+		return
+	}
+
+	var exact, sub bool
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		pattern, sub = pattern[2:], true
+	case strings.HasPrefix(pattern, "."):
+		pattern, exact, sub = pattern[1:], true, true
+	case strings.HasPrefix(pattern, "*"):
+		pattern, exact, sub = strings.TrimPrefix(pattern[1:], "."), true, true
+	default:
+		exact = true
+	}
+
+	node := s.node(normalizeName(pattern))
+	if exact {
+		node.exact = node.exact.with(port)
+	}
+	if sub {
+		node.sub = node.sub.with(port)
+	}
+}
+
+// PatternDomain returns the domain a name pattern is anchored to, false for
+// patterns matching other domains too: *, IPs, networks and regexps.
+func PatternDomain(pattern string) (string, bool) {
+	if strings.HasPrefix(pattern, "~") {
+		return "", false
+	}
+	pattern, _ = splitPattern(pattern)
+	if pattern == "*" || strings.Contains(pattern, "/") {
+		return "", false
+	}
+	if _, err := netip.ParseAddr(pattern); err == nil {
+		return "", false
+	}
+	pattern = strings.TrimPrefix(pattern, "*")
+	pattern = strings.TrimPrefix(pattern, ".")
+	return normalizeName(pattern), true
+}
+
+// NamePattern returns a name pattern in its canonical form, "example.com",
+// ".example.com" or "*.example.com", together with its port. It is false
+// for negations and patterns that are no names: *, IPs, networks, regexps.
+func NamePattern(pattern string) (string, string, bool) {
+	if strings.HasPrefix(pattern, "!") {
+		return "", "", false
+	}
+	domain, ok := PatternDomain(pattern)
+	if !ok || domain == "" {
+		return "", "", false
+	}
+	name, port := splitPattern(pattern)
+	switch {
+	case strings.HasPrefix(name, "*."):
+		return "*." + domain, port, true
+	case strings.HasPrefix(name, "*"), strings.HasPrefix(name, "."):
+		return "." + domain, port, true
+	}
+	return domain, port, true
+}
+
+// TargetHost returns the normalized host of target without its port.
+func TargetHost(target string) string {
+	host, _ := splitTarget(target)
+	return host
+}
+
+// node returns the trie node of name, creating the path to it.
+func (s *matchSet) node(name string) *labelNode {
+	if s.root == nil {
+		s.root = &labelNode{}
+	}
+	node := s.root
+	for name != "" {
+		var label string
+		label, name = lastLabel(name)
+		next := node.children[label]
+		if next == nil {
+			if node.children == nil {
+				node.children = make(map[string]*labelNode)
+			}
+			next = &labelNode{}
+			node.children[label] = next
+		}
+		node = next
+	}
+	return node
+}
+
+func (s *matchSet) match(host, port string) bool {
+	return s.any.allows(port) || s.matchNamed(host, port)
+}
+
+// matchNamed matches every pattern but the bare *.
+func (s *matchSet) matchNamed(host, port string) bool {
+	if len(s.prefixs) > 0 && maybeIP(host) {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addr = addr.Unmap()
+			for _, r := range s.prefixs {
+				if r.prefix.Contains(addr) && (r.port == "" || port == "" || r.port == port) {
+					return true
+				}
+			}
+		}
+	}
+
+	if node := s.root; node != nil {
+		name := host
+		for name != "" && node != nil {
+			var label string
+			label, name = lastLabel(name)
+			node = node.children[label]
+			if node == nil {
+				break
+			}
+			if name == "" {
+				if node.exact.allows(port) {
+					return true
+				}
+			} else if node.sub.allows(port) {
+				return true
+			}
+		}
+	}
+
+	for _, re := range s.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastLabel splits the rightmost label off name.
+func lastLabel(name string) (string, string) {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[i+1:], name[:i]
+	}
+	return name, ""
+}
+
+func (r *portRule) with(port string) *portRule {
+	if r == nil {
+		r = &portRule{}
+	}
+	if port == "" {
+		r.all = true
+		return r
+	}
+	if r.ports == nil {
+		r.ports = make(map[string]bool)
+	}
+	r.ports[port] = true
+	return r
+}
+
+// allows reports whether the rule exists and takes port, targets without
+// a port are only checked by name.
+func (r *portRule) allows(port string) bool {
+	return r != nil && (r.all || port == "" || r.ports[port])
+}
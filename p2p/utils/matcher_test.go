@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHostMatcherMatchesMatchHost(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		target   string
+		want     bool
+	}{
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"example.com"}, "EXAMPLE.com.", true},
+		{[]string{"example.com"}, "www.example.com", false},
+		{[]string{"*.example.com"}, "www.example.com", true},
+		{[]string{"*.example.com"}, "a.b.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{".example.com"}, "example.com", true},
+		{[]string{".example.com"}, "www.example.com", true},
+		{[]string{".example.com"}, "badexample.com", false},
+		{[]string{"*example.com"}, "example.com", true},
+		{[]string{"*example.com"}, "www.example.com", true},
+		{[]string{"*example.com"}, "badexample.com", false},
+		{[]string{"*"}, "anything.org", true},
+		{[]string{"*:443"}, "anything.org:443", true},
+		{[]string{"*:443"}, "anything.org:80", false},
+		{[]string{"*:443"}, "anything.org", true},
+		{[]string{"example.com:443"}, "example.com:443", true},
+		{[]string{"example.com:443"}, "example.com:8443", false},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:80", true},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3", false},
+		{[]string{"10.0.0.0/8"}, "10.example.com", false},
+		{[]string{"192.168.1.1"}, "192.168.1.1", true},
+		{[]string{"192.168.1.1"}, "192.168.1.2", false},
+		{[]string{"[2001:db8::/32]:443"}, "[2001:db8::1]:443", true},
+		{[]string{"[2001:db8::/32]:443"}, "[2001:db8::1]:80", false},
+		{[]string{"2001:db8::1"}, "[2001:db8::1]", true},
+		{[]string{`~^api[0-9]+\.x$`}, "api12.x", true},
+		{[]string{`~^api[0-9]+\.x$`}, "api.x", false},
+		{[]string{`~api[0-9]+`}, "api1.x", false},
+		{[]string{"~("}, "anything", false},
+		{[]string{".example.com", "!ads.example.com"}, "ads.example.com", false},
+		{[]string{".example.com", "!ads.example.com"}, "www.example.com", true},
+		{[]string{"!ads.example.com", "*"}, "ads.example.com", false},
+		{[]string{"!10.0.0.1", "10.0.0.0/8"}, "10.0.0.1", false},
+		{[]string{"!~^ads"}, "example.com", false},
+		{[]string{".bücher.example"}, "www.xn--bcher-kva.example", true},
+		{[]string{".xn--bcher-kva.example"}, "Bücher.example", true},
+		{nil, "example.com", false},
+		{[]string{"example.com"}, "", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchHost(tt.patterns, tt.target); got != tt.want {
+			t.Errorf("MatchHost(%q, %q) = %v, want %v", tt.patterns, tt.target, got, tt.want)
+		}
+		if got := CompileHosts(tt.patterns).Match(tt.target); got != tt.want {
+			t.Errorf("CompileHosts(%q).Match(%q) = %v, want %v", tt.patterns, tt.target, got, tt.want)
+		}
+	}
+}
+
+// benchPatterns returns n patterns of the forms found in provided host lists.
+func benchPatterns(n int) []string {
+	patterns := make([]string, 0, n)
+	for i := 0; len(patterns) < n; i++ {
+		switch i % 5 {
+		case 0:
+			patterns = append(patterns, fmt.Sprintf("site%d.example.com", i))
+		case 1:
+			patterns = append(patterns, fmt.Sprintf(".domain%d.org", i))
+		case 2:
+			patterns = append(patterns, fmt.Sprintf("*.cdn%d.net:443", i))
+		case 3:
+			patterns = append(patterns, fmt.Sprintf("10.%d.%d.0/24", i/256%256, i%256))
+		case 4:
+			patterns = append(patterns, fmt.Sprintf("!ads%d.domain%d.org", i, i-3))
+		}
+	}
+	return patterns
+}
+
+func BenchmarkHostMatcher(b *testing.B) {
+	targets := []string{
+		"www.domain3001.org",
+		"img.cdn4002.net:443",
+		"10.11.190.7",
+		"unknown.example.net",
+	}
+
+	for _, n := range []int{1000, 5000} {
+		patterns := benchPatterns(n)
+		m := CompileHosts(patterns)
+
+		b.Run(fmt.Sprintf("Compiled/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.Match(targets[i%len(targets)])
+			}
+		})
+		b.Run(fmt.Sprintf("MatchHost/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				MatchHost(patterns, targets[i%len(targets)])
+			}
+		})
+	}
+}
+
+func TestHostMatcherMatchSpecific(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		target   string
+		want     bool
+	}{
+		{[]string{"*"}, "example.com", false},
+		{[]string{"*:443"}, "example.com", false},
+		{[]string{"*", ".example.com"}, "www.example.com", true},
+		{[]string{"*", ".example.com"}, "other.org", false},
+		{[]string{".example.com", "!*"}, "www.example.com", false},
+		{[]string{"10.0.0.0/8", "*"}, "10.1.1.1", true},
+	}
+
+	for _, tt := range tests {
+		if got := CompileHosts(tt.patterns).MatchSpecific(tt.target); got != tt.want {
+			t.Errorf("CompileHosts(%q).MatchSpecific(%q) = %v, want %v", tt.patterns, tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package utils
+
+import "github.com/libp2p/go-libp2p/core/peer"
+
+// AllowedPeer reports whether id passes the access lists: it must not be in
+// deny and, when only is not empty, it must be listed there.
+func AllowedPeer(only, deny []string, id peer.ID) bool {
+	pid := id.String()
+	for _, d := range deny {
+		if d == pid {
+			return false
+		}
+	}
+	if len(only) == 0 {
+		return true
+	}
+	for _, o := range only {
+		if o == pid {
+			return true
+		}
+	}
+	return false
+}
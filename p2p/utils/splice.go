@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Splice copies a and b into each other until both directions are done. A
+// side reaching EOF is passed on as a half-close when the other side
+// supports it, so protocols that keep reading after their peer finished
+// sending still get the whole answer. Failed copies close both sides.
+func Splice(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			if cw.CloseWrite() == nil {
+				return
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+}
+
+// WithReader returns c reading from r, usually a bufio.Reader over c that
+// already holds bytes of the connection.
+func WithReader(c io.ReadWriteCloser, r io.Reader) io.ReadWriteCloser {
+	return &readerConn{c, r}
+}
+
+type readerConn struct {
+	io.ReadWriteCloser
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *readerConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}